@@ -16,8 +16,10 @@ import (
 	"go.opentelemetry.io/otel/trace"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/ipfs/go-blockservice/internal"
+	"github.com/ipfs/go-blockservice/titan"
 )
 
 var logger = logging.Logger("blockservice")
@@ -60,41 +62,134 @@ type BlockService interface {
 
 	// DeleteBlock deletes the given block from the blockservice.
 	DeleteBlock(ctx context.Context, o cid.Cid) error
+
+	// Has reports whether the block can be resolved by the load level
+	// found in ctx, without transferring block data where possible. The
+	// exchange is only asked when it implements HaveChecker.
+	Has(ctx context.Context, c cid.Cid) (bool, error)
+
+	// GetSize returns the size of the block resolved by the load level
+	// found in ctx.
+	GetSize(ctx context.Context, c cid.Cid) (int, error)
 }
 
 type blockService struct {
 	blockstore blockstore.Blockstore
+	exLk       sync.RWMutex
 	exchange   exchange.Interface
 	// If checkFirst is true then first check that a block doesn't
 	// already exist to avoid republishing the block on the exchange.
 	checkFirst bool
+	metrics    Metrics
+	observers  observers
+	limits     [numSources]*rateLimiter
+	queue      *fetchQueue
+	cache      *memoryCache
+	fetched    *fetchCache
+	policy     CachePolicy
+	// strictLevels fails load levels with unavailable sources instead of
+	// degrading them, see WithOfflineDegrade.
+	strictLevels bool
+
+	batchSize         int
+	batchLatency      time.Duration
+	reorderWindow     int
+	streamConcurrency int
+
+	life         *lifecycle
+	closeTimeout time.Duration
+	closeOnce    sync.Once
+	closeErr     error
+}
+
+// Option configures a BlockService.
+type Option func(*blockService)
+
+// WithMetrics sets the Metrics receiving measurements about every block
+// source. By default nothing is recorded.
+func WithMetrics(m Metrics) Option {
+	return func(s *blockService) {
+		if m == nil {
+			m = noopMetrics{}
+		}
+		s.metrics = m
+	}
+}
+
+const (
+	defaultBatchSize    = 32
+	defaultBatchLatency = 50 * time.Millisecond
+	// writeBackQueue is the number of batches waiting to be written back
+	// before delivery waits for the blockstore.
+	writeBackQueue = 4
+)
+
+// WithWriteBatching sets how blocks received from the exchange are written
+// back to the blockstore: in batches of up to size blocks, flushed at the
+// latest maxLatency after the first block of the batch arrived. Blocks are
+// delivered to the caller as they arrive, before they are written. The
+// defaults are 32 blocks and 50ms.
+func WithWriteBatching(size int, maxLatency time.Duration) Option {
+	return func(s *blockService) {
+		s.batchSize = size
+		s.batchLatency = maxLatency
+	}
+}
+
+// CachePolicy decides what happens to blocks fetched from the exchange that
+// can't be written to the blockstore.
+type CachePolicy uint8
+
+const (
+	CacheStrict     CachePolicy = iota // fail the request
+	CacheBestEffort                    // return the blocks anyway
+)
+
+// WithCachePolicy sets the CachePolicy, CacheStrict by default. Failed
+// writes are recorded by Metrics.WriteFailed and
+// BlockServiceObserver.OnWriteFailed with either policy.
+func WithCachePolicy(p CachePolicy) Option {
+	return func(s *blockService) {
+		s.policy = p
+	}
 }
 
 // NewBlockService creates a BlockService with given datastore instance.
-func New(bs blockstore.Blockstore, rem exchange.Interface) BlockService {
+func New(bs blockstore.Blockstore, rem exchange.Interface, opts ...Option) BlockService {
 	if rem == nil {
 		logger.Debug("blockservice running in local (offline) mode.")
 	}
 
-	return &blockService{
-		blockstore: bs,
-		exchange:   rem,
-		checkFirst: true,
-	}
+	return newBlockService(bs, rem, true, opts)
 }
 
 // NewWriteThrough creates a BlockService that guarantees writes will go
 // through to the blockstore and are not skipped by cache checks.
-func NewWriteThrough(bs blockstore.Blockstore, rem exchange.Interface) BlockService {
+func NewWriteThrough(bs blockstore.Blockstore, rem exchange.Interface, opts ...Option) BlockService {
 	if rem == nil {
 		logger.Debug("blockservice running in local (offline) mode.")
 	}
 
-	return &blockService{
+	return newBlockService(bs, rem, false, opts)
+}
+
+func newBlockService(bs blockstore.Blockstore, rem exchange.Interface, checkFirst bool, opts []Option) *blockService {
+	s := &blockService{
 		blockstore: bs,
 		exchange:   rem,
-		checkFirst: false,
+		checkFirst: checkFirst,
+		metrics:    noopMetrics{},
+		queue:      newFetchQueue(defaultFetchConcurrency),
+
+		batchSize:    defaultBatchSize,
+		batchLatency: defaultBatchLatency,
+		life:         newLifecycle(),
+		closeTimeout: defaultCloseTimeout,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 // Blockstore returns the blockstore behind this blockservice.
@@ -104,7 +199,7 @@ func (s *blockService) Blockstore() blockstore.Blockstore {
 
 // Exchange returns the exchange behind this blockservice.
 func (s *blockService) Exchange() exchange.Interface {
-	return s.exchange
+	return s.currentExchange()
 }
 
 // NewSession creates a new session that allows for
@@ -113,6 +208,11 @@ func (s *blockService) Exchange() exchange.Interface {
 // session will be created. Otherwise, the current exchange will be used
 // directly.
 func NewSession(ctx context.Context, bs BlockService) *Session {
+	base := loader{metrics: noopMetrics{}}
+	if s, ok := bs.(*blockService); ok {
+		base = s.loader(nil)
+	}
+
 	exch := bs.Exchange()
 	if sessEx, ok := exch.(exchange.SessionExchange); ok {
 		return &Session{
@@ -121,6 +221,7 @@ func NewSession(ctx context.Context, bs BlockService) *Session {
 			sessEx:   sessEx,
 			bs:       bs.Blockstore(),
 			notifier: exch,
+			base:     base,
 		}
 	}
 	return &Session{
@@ -128,6 +229,7 @@ func NewSession(ctx context.Context, bs BlockService) *Session {
 		sessCtx:  ctx,
 		bs:       bs.Blockstore(),
 		notifier: exch,
+		base:     base,
 	}
 }
 
@@ -136,6 +238,12 @@ func (s *blockService) AddBlock(ctx context.Context, o blocks.Block) error {
 	ctx, span := internal.StartSpan(ctx, "blockService.AddBlock")
 	defer span.End()
 
+	ctx, done := s.life.begin(ctx)
+	if done == nil {
+		return ErrClosed
+	}
+	defer done()
+
 	c := o.Cid()
 	// hash security
 	err := verifcid.ValidateCid(c)
@@ -149,13 +257,16 @@ func (s *blockService) AddBlock(ctx context.Context, o blocks.Block) error {
 	}
 
 	if err := s.blockstore.Put(ctx, o); err != nil {
+		s.recordAdded(ctx, []blocks.Block{o}, err)
 		return err
 	}
+	s.recordAdded(ctx, []blocks.Block{o}, nil)
 
 	logger.Debugf("BlockService.BlockAdded %s", c)
+	s.observers.added(c, len(o.RawData()))
 
-	if s.exchange != nil {
-		if err := s.exchange.NotifyNewBlocks(ctx, o); err != nil {
+	if ex := s.currentExchange(); ex != nil {
+		if err := ex.NotifyNewBlocks(ctx, o); err != nil {
 			logger.Errorf("NotifyNewBlocks: %s", err.Error())
 		}
 	}
@@ -167,6 +278,12 @@ func (s *blockService) AddBlocks(ctx context.Context, bs []blocks.Block) error {
 	ctx, span := internal.StartSpan(ctx, "blockService.AddBlocks")
 	defer span.End()
 
+	ctx, done := s.life.begin(ctx)
+	if done == nil {
+		return ErrClosed
+	}
+	defer done()
+
 	// hash security
 	for _, b := range bs {
 		err := verifcid.ValidateCid(b.Cid())
@@ -195,68 +312,105 @@ func (s *blockService) AddBlocks(ctx context.Context, bs []blocks.Block) error {
 	}
 
 	err := s.blockstore.PutMany(ctx, toput)
+	s.recordAdded(ctx, toput, err)
 	if err != nil {
 		return err
 	}
+	for _, b := range toput {
+		s.observers.added(b.Cid(), len(b.RawData()))
+	}
 
-	if s.exchange != nil {
+	if ex := s.currentExchange(); ex != nil {
 		logger.Debugf("BlockService.BlockAdded %d blocks", len(toput))
-		if err := s.exchange.NotifyNewBlocks(ctx, toput...); err != nil {
+		if err := ex.NotifyNewBlocks(ctx, toput...); err != nil {
 			logger.Errorf("NotifyNewBlocks: %s", err.Error())
 		}
 	}
 	return nil
 }
 
+// recordAdded records the outcome of writing blks added by the caller,
+// labelled with the load level found in ctx.
+func (s *blockService) recordAdded(ctx context.Context, blks []blocks.Block, err error) {
+	level, lerr := loadLevelFromContext(ctx)
+	if lerr != nil {
+		return
+	}
+	if err != nil {
+		s.metrics.WriteFailed(level, len(blks), err)
+		return
+	}
+	size := 0
+	for _, b := range blks {
+		size += len(b.RawData())
+	}
+	s.metrics.Written(level, len(blks), size)
+}
+
 // GetBlock retrieves a particular block from the service,
 // Getting it from the datastore using the key (hash).
 func (s *blockService) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error) {
 	ctx, span := internal.StartSpan(ctx, "blockService.GetBlock", trace.WithAttributes(attribute.Stringer("CID", c)))
 	defer span.End()
 
-	var f func() notifiableFetcher
-	if s.exchange != nil {
-		f = s.getExchange
+	ctx, done := s.life.begin(ctx)
+	if done == nil {
+		return nil, ErrClosed
 	}
+	defer done()
+
+	f := s.fetcher()
 
-	return getBlock(ctx, c, s.blockstore, f) // hash security
+	return getBlock(ctx, c, s.loader(f)) // hash security
 }
 
-func (s *blockService) getExchange() notifiableFetcher {
-	return s.exchange
+func (s *blockService) loader(fget func() notifiableFetcher) loader {
+	return loader{
+		bs:                s.blockstore,
+		fget:              fget,
+		metrics:           s.metrics,
+		observers:         s.observers,
+		limits:            s.limits,
+		queue:             s.queue,
+		cache:             s.cache,
+		fetched:           s.fetched,
+		policy:            s.policy,
+		strictLevels:      s.strictLevels,
+		batchSize:         s.batchSize,
+		batchLatency:      s.batchLatency,
+		reorderWindow:     s.reorderWindow,
+		streamConcurrency: s.streamConcurrency,
+		life:              s.life,
+	}
 }
 
-func getBlock(ctx context.Context, c cid.Cid, bs blockstore.Blockstore, fget func() notifiableFetcher) (blocks.Block, error) {
+func getBlock(ctx context.Context, c cid.Cid, l loader) (blocks.Block, error) {
 	err := verifcid.ValidateCid(c) // hash security
 	if err != nil {
 		return nil, err
 	}
 
-	loadLevelInf := ctx.Value(LoadLevelOfSign)
-	// other default
-	if loadLevelInf == nil {
-		loadLevelInf = LoadOfLocalTitanIpfs.Uint8()
-	}
-	if loadLevel, ok := loadLevelInf.(uint8); ok {
-		switch loadLevel {
-		case LoadOfLocalTitanIpfs.Uint8():
-			return loadBlockByLocalTitanIpfs(ctx, c, bs, fget)
-		case LoadOfLocalTitan.Uint8():
-			return loadBlockByLocalTitan(ctx, c, bs)
-		case LoadOfLocalIpfs.Uint8():
-			return loadBlockByLocalIpfs(ctx, c, bs, fget)
-		case LoadOfOnlyLocal.Uint8():
-			return loadBlockByLocal(ctx, c, bs)
-		case LoadOfOnlyTitan.Uint8():
-			return loadBlockByTitan(ctx, c)
-		case LoadOfOnlyIpfs.Uint8():
-			return loadBlockByIpfs(ctx, c, bs, fget)
-		default:
-			return nil, fmt.Errorf("unknown load level")
-		}
+	l.level, err = l.requestLevel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Stringer("LoadLevel", l.level))
+	switch l.level {
+	case LoadOfLocalTitanIpfs:
+		return l.loadBlockByLocalTitanIpfs(ctx, c)
+	case LoadOfLocalTitan:
+		return l.loadBlockByLocalTitan(ctx, c)
+	case LoadOfLocalIpfs:
+		return l.loadBlockByLocalIpfs(ctx, c)
+	case LoadOfOnlyLocal:
+		return l.loadBlockByLocal(ctx, c)
+	case LoadOfOnlyTitan:
+		return l.loadBlockByTitan(ctx, c)
+	case LoadOfOnlyIpfs:
+		return l.loadBlockByIpfs(ctx, c)
+	default:
+		return nil, fmt.Errorf("unknown load level")
 	}
-
-	return nil, fmt.Errorf("load level type fail")
 }
 
 // GetBlocks gets a list of blocks asynchronously and returns through
@@ -266,17 +420,22 @@ func (s *blockService) GetBlocks(ctx context.Context, ks []cid.Cid) <-chan block
 	ctx, span := internal.StartSpan(ctx, "blockService.GetBlocks")
 	defer span.End()
 
-	var f func() notifiableFetcher
-	if s.exchange != nil {
-		f = s.getExchange
+	ctx, done := s.life.begin(ctx)
+	if done == nil {
+		return closedBlocks()
 	}
-	return getBlocks(ctx, ks, s.blockstore, f) // hash security
+
+	f := s.fetcher()
+	l := s.loader(f)
+	l.release = done
+	return getBlocks(ctx, ks, l) // hash security
 }
 
-func getBlocks(ctx context.Context, ks []cid.Cid, bs blockstore.Blockstore, fget func() notifiableFetcher) <-chan blocks.Block {
+func getBlocks(ctx context.Context, ks []cid.Cid, l loader) <-chan blocks.Block {
 	out := make(chan blocks.Block)
 
 	go func() {
+		defer l.finish()
 		defer close(out)
 
 		allValid := true
@@ -300,28 +459,25 @@ func getBlocks(ctx context.Context, ks []cid.Cid, bs blockstore.Blockstore, fget
 			ks = ks2
 		}
 
-		loadLevelInf := ctx.Value(LoadLevelOfSign)
-		// other default
-		if loadLevelInf == nil {
-			loadLevelInf = LoadOfLocalTitanIpfs.Uint8()
+		level, err := l.requestLevel(ctx)
+		if err != nil {
+			logger.Errorf("blockService.GetBlocks: %s", err)
+			return
 		}
-		if loadLevel, ok := loadLevelInf.(uint8); ok {
-			switch loadLevel {
-			case LoadOfLocalTitanIpfs.Uint8():
-				loadBlocksByLocalTitanIpfs(ctx, ks, bs, fget, out)
-			case LoadOfLocalTitan.Uint8():
-				loadBlocksByLocalTitan(ctx, ks, bs, out)
-			case LoadOfLocalIpfs.Uint8():
-				loadBlocksByLocalIpfs(ctx, ks, bs, fget, out)
-			case LoadOfOnlyLocal.Uint8():
-				loadBlocksByLocal(ctx, ks, bs, out)
-			case LoadOfOnlyTitan.Uint8():
-				loadBlocksByTitan(ctx, ks, out)
-			case LoadOfOnlyIpfs.Uint8():
-				loadBlocksByIpfs(ctx, ks, bs, fget, out)
-			default:
-				return
-			}
+		l.level = level
+		switch level {
+		case LoadOfLocalTitanIpfs:
+			l.loadBlocksByLocalTitanIpfs(ctx, ks, out)
+		case LoadOfLocalTitan:
+			l.loadBlocksByLocalTitan(ctx, ks, out)
+		case LoadOfLocalIpfs:
+			l.loadBlocksByLocalIpfs(ctx, ks, out)
+		case LoadOfOnlyLocal:
+			l.loadBlocksByLocal(ctx, ks, out)
+		case LoadOfOnlyTitan:
+			l.loadBlocksByTitan(ctx, ks, out)
+		case LoadOfOnlyIpfs:
+			l.loadBlocksByIpfs(ctx, ks, out)
 		}
 	}()
 	return out
@@ -332,16 +488,42 @@ func (s *blockService) DeleteBlock(ctx context.Context, c cid.Cid) error {
 	ctx, span := internal.StartSpan(ctx, "blockService.DeleteBlock", trace.WithAttributes(attribute.Stringer("CID", c)))
 	defer span.End()
 
+	ctx, done := s.life.begin(ctx)
+	if done == nil {
+		return ErrClosed
+	}
+	defer done()
+
 	err := s.blockstore.DeleteBlock(ctx, c)
+	s.cache.remove(c)
+	if s.fetched != nil {
+		s.fetched.remove(ctx, c)
+	}
 	if err == nil {
 		logger.Debugf("BlockService.BlockDeleted %s", c)
+		s.observers.deleted(c)
 	}
 	return err
 }
 
+// Close rejects new requests with ErrClosed, lets the requests in flight
+// finish for up to the close timeout, cancels the remaining ones and waits
+// for their blocks to be written back. It then closes the idle titan
+// connections and the exchange. Calling Close again returns the first
+// result.
 func (s *blockService) Close() error {
-	logger.Debug("blockservice is shutting down...")
-	return s.exchange.Close()
+	s.closeOnce.Do(func() {
+		logger.Debug("blockservice is shutting down...")
+		s.life.shutdown(s.closeTimeout)
+		if s.fetched != nil {
+			s.fetched.close()
+		}
+		titan.CloseIdleConnections()
+		if ex := s.currentExchange(); ex != nil {
+			s.closeErr = ex.Close()
+		}
+	})
+	return s.closeErr
 }
 
 type notifier interface {
@@ -355,7 +537,9 @@ type Session struct {
 	sessEx   exchange.SessionExchange
 	sessCtx  context.Context
 	notifier notifier
-	lk       sync.Mutex
+	// base carries the service configuration shared by every request
+	base loader
+	lk   sync.Mutex
 }
 
 type notifiableFetcher interface {
@@ -398,7 +582,13 @@ func (s *Session) GetBlock(ctx context.Context, c cid.Cid) (blocks.Block, error)
 	ctx, span := internal.StartSpan(ctx, "Session.GetBlock", trace.WithAttributes(attribute.Stringer("CID", c)))
 	defer span.End()
 
-	return getBlock(ctx, c, s.bs, s.getFetcherFactory()) // hash security
+	ctx, done := s.base.life.begin(ctx)
+	if done == nil {
+		return nil, ErrClosed
+	}
+	defer done()
+
+	return getBlock(ctx, c, s.loader()) // hash security
 }
 
 // GetBlocks gets blocks in the context of a request session
@@ -406,7 +596,20 @@ func (s *Session) GetBlocks(ctx context.Context, ks []cid.Cid) <-chan blocks.Blo
 	ctx, span := internal.StartSpan(ctx, "Session.GetBlocks")
 	defer span.End()
 
-	return getBlocks(ctx, ks, s.bs, s.getFetcherFactory()) // hash security
+	ctx, done := s.base.life.begin(ctx)
+	if done == nil {
+		return closedBlocks()
+	}
+	l := s.loader()
+	l.release = done
+	return getBlocks(ctx, ks, l) // hash security
+}
+
+func (s *Session) loader() loader {
+	l := s.base
+	l.bs = s.bs
+	l.fget = s.getFetcherFactory()
+	return l
 }
 
 var _ BlockGetter = (*Session)(nil)
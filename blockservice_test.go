@@ -1,9 +1,21 @@
 package blockservice
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/filecoin-project/go-jsonrpc"
 	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
@@ -13,6 +25,11 @@ import (
 	exchange "github.com/ipfs/go-ipfs-exchange-interface"
 	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/linguohua/titan/api"
+	mh "github.com/multiformats/go-multihash"
+
+	"github.com/ipfs/go-blockservice/internal/car"
+	"github.com/ipfs/go-blockservice/titan"
 )
 
 func TestWriteThroughWorks(t *testing.T) {
@@ -241,3 +258,1805 @@ func TestNilExchange(t *testing.T) {
 		t.Fatal("got the wrong block")
 	}
 }
+
+type countingMetrics struct {
+	lk        sync.Mutex
+	requested map[Source]int
+	hits      map[Source]int
+	misses    map[Source]int
+	errors    map[Source]int
+	written   int
+	failed    int
+}
+
+func newCountingMetrics() *countingMetrics {
+	return &countingMetrics{
+		requested: make(map[Source]int),
+		hits:      make(map[Source]int),
+		misses:    make(map[Source]int),
+		errors:    make(map[Source]int),
+	}
+}
+
+func (m *countingMetrics) Requested(_ LoadLevel, source Source) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.requested[source]++
+}
+
+func (m *countingMetrics) Hit(_ LoadLevel, source Source, _ int, _ time.Duration) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.hits[source]++
+}
+
+func (m *countingMetrics) Miss(_ LoadLevel, source Source, _ time.Duration) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.misses[source]++
+}
+
+func (m *countingMetrics) Failed(_ LoadLevel, source Source, _ error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.errors[source]++
+}
+
+func (m *countingMetrics) Written(_ LoadLevel, n int, _ int) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.written += n
+}
+
+func (m *countingMetrics) WriteFailed(_ LoadLevel, n int, _ error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	m.failed += n
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfLocalIpfs.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	m := newCountingMetrics()
+	bserv := New(bstore, offline.Exchange(exchbstore), WithMetrics(m))
+	bgen := butil.NewBlockGenerator()
+
+	block := bgen.Next()
+	if err := exchbstore.Put(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bserv.GetBlock(ctx, block.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if m.misses[SourceLocal] != 1 || m.hits[SourceIpfs] != 1 || m.written != 1 {
+		t.Fatalf("unexpected metrics after remote fetch: %+v", m)
+	}
+
+	if _, err := bserv.GetBlock(ctx, block.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if m.hits[SourceLocal] != 1 || m.requested[SourceIpfs] != 1 {
+		t.Fatalf("unexpected metrics after local fetch: %+v", m)
+	}
+
+	missing := bgen.Next()
+	for range bserv.GetBlocks(ctx, []cid.Cid{block.Cid(), missing.Cid()}) {
+	}
+	if m.hits[SourceLocal] != 2 || m.misses[SourceIpfs] != 1 {
+		t.Fatalf("unexpected metrics after GetBlocks: %+v", m)
+	}
+
+	if err := bserv.AddBlock(ctx, bgen.Next()); err != nil {
+		t.Fatal(err)
+	}
+	if m.written != 2 {
+		t.Fatalf("expected added blocks to be counted as written: %+v", m)
+	}
+
+	// a block titan does not have is a miss, not an error
+	tctx := context.WithValue(withScheduler(t, &downloadScheduler{}), LoadLevelOfSign, LoadOfOnlyTitan.Uint8())
+	if _, err := bserv.GetBlock(tctx, missing.Cid()); !ipld.IsNotFound(err) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+	if m.misses[SourceTitan] != 1 || m.errors[SourceTitan] != 0 {
+		t.Fatalf("unexpected metrics after a titan miss: %+v", m)
+	}
+}
+
+type recordingObserver struct {
+	lk      sync.Mutex
+	fetched map[cid.Cid]Source
+	added   []cid.Cid
+	deleted []cid.Cid
+	failed  map[cid.Cid]Source
+	unsaved []cid.Cid
+}
+
+func (o *recordingObserver) OnBlockFetched(c cid.Cid, source Source, _ time.Duration, _ int) {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	o.fetched[c] = source
+}
+
+func (o *recordingObserver) OnBlockAdded(c cid.Cid, _ int) {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	o.added = append(o.added, c)
+}
+
+func (o *recordingObserver) OnBlockDeleted(c cid.Cid) {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	o.deleted = append(o.deleted, c)
+}
+
+func (o *recordingObserver) OnFetchFailed(c cid.Cid, source Source, _ error) {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	o.failed[c] = source
+}
+
+func (o *recordingObserver) OnWriteFailed(c cid.Cid, _ error) {
+	o.lk.Lock()
+	defer o.lk.Unlock()
+	o.unsaved = append(o.unsaved, c)
+}
+
+func TestObserver(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfLocalIpfs.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	obs := &recordingObserver{fetched: make(map[cid.Cid]Source), failed: make(map[cid.Cid]Source)}
+	bserv := New(bstore, offline.Exchange(exchbstore), WithObserver(obs))
+	bgen := butil.NewBlockGenerator()
+
+	local := bgen.Next()
+	if err := bserv.AddBlock(ctx, local); err != nil {
+		t.Fatal(err)
+	}
+	if len(obs.added) != 1 || obs.added[0] != local.Cid() {
+		t.Fatalf("expected %s to be reported as added, got %v", local.Cid(), obs.added)
+	}
+
+	remote := bgen.Next()
+	if err := exchbstore.Put(ctx, remote); err != nil {
+		t.Fatal(err)
+	}
+	missing := bgen.Next()
+	for range NewSession(ctx, bserv).GetBlocks(ctx, []cid.Cid{local.Cid(), remote.Cid(), missing.Cid()}) {
+	}
+	if src, ok := obs.fetched[local.Cid()]; !ok || src != SourceLocal {
+		t.Fatalf("expected %s to be fetched from local, got %v", local.Cid(), src)
+	}
+	if src, ok := obs.fetched[remote.Cid()]; !ok || src != SourceIpfs {
+		t.Fatalf("expected %s to be fetched from ipfs, got %v", remote.Cid(), src)
+	}
+	if src, ok := obs.failed[missing.Cid()]; !ok || src != SourceIpfs {
+		t.Fatalf("expected %s to fail from ipfs, got %v", missing.Cid(), src)
+	}
+
+	if err := bserv.DeleteBlock(ctx, local.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if len(obs.deleted) != 1 || obs.deleted[0] != local.Cid() {
+		t.Fatalf("expected %s to be reported as deleted, got %v", local.Cid(), obs.deleted)
+	}
+}
+
+func TestAsBlockstore(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfLocalIpfs.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bs := AsBlockstore(New(bstore, offline.Exchange(exchbstore)))
+	bgen := butil.NewBlockGenerator()
+
+	local := bgen.Next()
+	if err := bs.Put(ctx, local); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := bstore.Has(ctx, local.Cid()); err != nil || !has {
+		t.Fatal("expected Put to write to the underlying blockstore")
+	}
+
+	remote := bgen.Next()
+	if err := exchbstore.Put(ctx, remote); err != nil {
+		t.Fatal(err)
+	}
+	size, err := bs.GetSize(ctx, remote.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len(remote.RawData()) {
+		t.Fatalf("expected size %d, got %d", len(remote.RawData()), size)
+	}
+	got, err := bs.Get(ctx, remote.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Cid() != remote.Cid() {
+		t.Fatal("got the wrong block")
+	}
+
+	missing := bgen.Next()
+	if has, err := bs.Has(ctx, missing.Cid()); err != nil || has {
+		t.Fatalf("expected missing block to not be found, got %v, %v", has, err)
+	}
+
+	if err := bs.DeleteBlock(ctx, local.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := bstore.Has(ctx, local.Cid()); err != nil || has {
+		t.Fatal("expected DeleteBlock to remove the block from the underlying blockstore")
+	}
+}
+
+var _ HaveChecker = (*haveCheckingExchange)(nil)
+
+type haveCheckingExchange struct {
+	exchange.Interface
+	bs blockstore.Blockstore
+}
+
+func (e *haveCheckingExchange) Have(ctx context.Context, c cid.Cid) (bool, error) {
+	return e.bs.Has(ctx, c)
+}
+
+func TestHasAndGetSize(t *testing.T) {
+	ctx := context.Background()
+
+	bstore := &PutCountingBlockstore{
+		blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		0,
+	}
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exch := &haveCheckingExchange{offline.Exchange(exchbstore), exchbstore}
+	bserv := New(bstore, exch)
+	bgen := butil.NewBlockGenerator()
+
+	local := bgen.Next()
+	remote := bgen.Next()
+	if err := bstore.Put(ctx, local); err != nil {
+		t.Fatal(err)
+	}
+	if err := exchbstore.Put(ctx, remote); err != nil {
+		t.Fatal(err)
+	}
+
+	localCtx := context.WithValue(ctx, LoadLevelOfSign, LoadOfOnlyLocal.Uint8())
+	ipfsCtx := context.WithValue(ctx, LoadLevelOfSign, LoadOfLocalIpfs.Uint8())
+
+	for _, tc := range []struct {
+		ctx  context.Context
+		c    cid.Cid
+		want bool
+	}{
+		{localCtx, local.Cid(), true},
+		{localCtx, remote.Cid(), false},
+		{ipfsCtx, remote.Cid(), true},
+		{ipfsCtx, bgen.Next().Cid(), false},
+	} {
+		has, err := bserv.Has(tc.ctx, tc.c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if has != tc.want {
+			t.Fatalf("Has(%s) = %v, want %v", tc.c, has, tc.want)
+		}
+	}
+	if bstore.PutCounter != 1 {
+		t.Fatalf("Has should not have fetched the remote block, have %d Put calls", bstore.PutCounter)
+	}
+
+	if _, err := bserv.GetSize(localCtx, remote.Cid()); !ipld.IsNotFound(err) {
+		t.Fatalf("expected local GetSize to not find the remote block, got %v", err)
+	}
+	size, err := bserv.GetSize(ipfsCtx, remote.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != len(remote.RawData()) {
+		t.Fatalf("expected size %d, got %d", len(remote.RawData()), size)
+	}
+}
+
+var _ BatchDeleter = (*batchDeletingBlockstore)(nil)
+
+type batchDeletingBlockstore struct {
+	blockstore.Blockstore
+	batches int
+}
+
+func (bs *batchDeletingBlockstore) DeleteMany(ctx context.Context, ks []cid.Cid) error {
+	bs.batches++
+	for _, c := range ks {
+		if err := bs.Blockstore.DeleteBlock(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ RemovalNotifier = (*removalCountingExchange)(nil)
+
+type removalCountingExchange struct {
+	exchange.Interface
+	removed int
+}
+
+func (e *removalCountingExchange) NotifyRemovedBlocks(_ context.Context, ks ...cid.Cid) error {
+	e.removed += len(ks)
+	return nil
+}
+
+func TestDeleteBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	bstore := &batchDeletingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	exch := &removalCountingExchange{Interface: offline.Exchange(bstore)}
+	bserv := New(bstore, exch)
+	bgen := butil.NewBlockGenerator()
+
+	var ks []cid.Cid
+	for i := 0; i < 3; i++ {
+		b := bgen.Next()
+		if err := bserv.AddBlock(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, b.Cid())
+	}
+
+	results := bserv.(BlocksDeleter).DeleteBlocks(ctx, ks, NotifyExchange())
+	if len(results) != len(ks) {
+		t.Fatalf("expected %d results, got %d", len(ks), len(results))
+	}
+	for i, r := range results {
+		if r.Cid != ks[i] {
+			t.Fatalf("result %d is for %s, expected %s", i, r.Cid, ks[i])
+		}
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		if has, _ := bstore.Has(ctx, r.Cid); has {
+			t.Fatalf("block %s was not deleted", r.Cid)
+		}
+	}
+	if bstore.batches != 1 {
+		t.Fatalf("expected one batch delete, got %d", bstore.batches)
+	}
+	if exch.removed != len(ks) {
+		t.Fatalf("expected the exchange to be told about %d removed blocks, got %d", len(ks), exch.removed)
+	}
+}
+
+// linkCodec is a test codec whose blocks hold a newline separated list of
+// CIDs.
+const linkCodec = 0x300000
+
+type linkNode struct {
+	ipld.Node // only Links is used
+	links     []*ipld.Link
+}
+
+func (n *linkNode) Links() []*ipld.Link {
+	return n.links
+}
+
+type linkDecoder struct{}
+
+func (linkDecoder) Register(uint64, ipld.DecodeBlockFunc) {}
+
+func (linkDecoder) Decode(b blocks.Block) (ipld.Node, error) {
+	if b.Cid().Type() != linkCodec {
+		return nil, fmt.Errorf("unrecognized object type: %d", b.Cid().Type())
+	}
+	n := &linkNode{}
+	for _, s := range strings.Fields(string(b.RawData())) {
+		c, err := cid.Decode(s)
+		if err != nil {
+			return nil, err
+		}
+		n.links = append(n.links, &ipld.Link{Cid: c})
+	}
+	return n, nil
+}
+
+func newLinkBlock(t *testing.T, children ...blocks.Block) blocks.Block {
+	var data []string
+	for _, c := range children {
+		data = append(data, c.Cid().String())
+	}
+	c, err := cid.NewPrefixV1(linkCodec, mh.SHA2_256).Sum([]byte(strings.Join(data, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := blocks.NewBlockWithCid([]byte(strings.Join(data, "\n")), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// newTestDAG returns a root with two children of two raw leaves each, root
+// first, then breadth first.
+func newTestDAG(t *testing.T) []blocks.Block {
+	var leaves []blocks.Block
+	for i := 0; i < 4; i++ {
+		leaves = append(leaves, blocks.NewBlock([]byte(fmt.Sprintf("leaf %d", i))))
+	}
+	left := newLinkBlock(t, leaves[0], leaves[1])
+	right := newLinkBlock(t, leaves[2], leaves[3])
+	root := newLinkBlock(t, left, right)
+	return append([]blocks.Block{root, left, right}, leaves...)
+}
+
+func TestPrefetch(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfLocalIpfs.Uint8())
+
+	for _, tc := range []struct {
+		maxDepth int
+		want     int
+	}{
+		{0, 7},
+		{1, 3},
+	} {
+		bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		bserv := New(bstore, offline.Exchange(exchbstore))
+
+		dag := newTestDAG(t)
+		if err := exchbstore.PutMany(ctx, dag); err != nil {
+			t.Fatal(err)
+		}
+
+		err := Prefetch(ctx, bserv, dag[0].Cid(), PrefetchOptions{
+			MaxDepth:    tc.maxDepth,
+			Concurrency: 2,
+			Decoder:     linkDecoder{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, b := range dag {
+			has, err := bstore.Has(ctx, b.Cid())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if has != (i < tc.want) {
+				t.Fatalf("max depth %d: block %d is local: %v", tc.maxDepth, i, has)
+			}
+		}
+	}
+}
+
+type downloadScheduler struct {
+	edgeURL string
+}
+
+func (s *downloadScheduler) GetDownloadInfoWithBlock(context.Context, string, string) (api.DownloadInfo, error) {
+	return api.DownloadInfo{URL: s.edgeURL, Token: "token"}, nil
+}
+
+// newTitan serves blks as a CAR from an edge node and returns a context
+// whose titan scheduler points at it.
+func newTitan(t *testing.T, blks []blocks.Block) context.Context {
+	var payload bytes.Buffer
+	cw, err := car.NewWriter(&payload, []cid.Cid{blks[0].Cid()}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blks {
+		if err := cw.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", titan.CarContentType)
+		w.Write(payload.Bytes())
+	}))
+	t.Cleanup(edge.Close)
+
+	return withScheduler(t, &downloadScheduler{edgeURL: edge.URL})
+}
+
+// withScheduler serves handler as a titan scheduler RPC and returns a
+// context pointing titan at it.
+func withScheduler(t *testing.T, handler interface{}) context.Context {
+	rpc := jsonrpc.NewServer()
+	rpc.Register("titan", handler)
+	mux := http.NewServeMux()
+	mux.Handle(titan.RPCProtocol, rpc)
+	sched := httptest.NewServer(mux)
+	t.Cleanup(sched.Close)
+	host, port, err := net.SplitHostPort(sched.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return context.WithValue(context.Background(), "TitanIps", []string{fmt.Sprintf("/ip4/%s/tcp/%s", host, port)})
+}
+
+// hangingScheduler answers download info requests only once release is
+// closed.
+type hangingScheduler struct {
+	release chan struct{}
+}
+
+func (s *hangingScheduler) GetDownloadInfoWithBlock(ctx context.Context, _, _ string) (api.DownloadInfo, error) {
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+	}
+	return api.DownloadInfo{}, nil
+}
+
+// withHangingScheduler returns a context pointing titan at a scheduler that
+// never answers while the test runs.
+func withHangingScheduler(t *testing.T) context.Context {
+	sched := &hangingScheduler{release: make(chan struct{})}
+	ctx := withScheduler(t, sched)
+	t.Cleanup(func() { close(sched.release) })
+	return ctx
+}
+
+func TestPrefetchFromTitan(t *testing.T) {
+	dag := newTestDAG(t)
+	opts := PrefetchOptions{Decoder: linkDecoder{}}
+
+	// blocks go to the fetch cache
+	ctx := newTitan(t, dag)
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	cstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithFetchCache(cstore, FetchCacheOptions{}))
+	if err := PrefetchFromTitan(ctx, bserv, dag[0].Cid(), opts); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range dag {
+		if has, _ := cstore.Has(ctx, b.Cid()); !has {
+			t.Fatalf("block %s not in the fetch cache", b.Cid())
+		}
+		if has, _ := bstore.Has(ctx, b.Cid()); has {
+			t.Fatalf("block %s written to the primary blockstore", b.Cid())
+		}
+	}
+
+	// blocks outside of the DAG abort the stream
+	foreign := blocks.NewBlock([]byte("not linked"))
+	ctx = newTitan(t, append(dag[:3:3], foreign))
+	bstore = blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	if err := PrefetchFromTitan(ctx, New(bstore, nil), dag[0].Cid(), opts); err == nil {
+		t.Fatal("expected a block outside of the DAG to fail the prefetch")
+	}
+	if has, _ := bstore.Has(ctx, foreign.Cid()); has {
+		t.Fatal("block outside of the DAG was stored")
+	}
+}
+
+// newDagPBBlock returns a dag-pb node holding data and linking to children.
+func newDagPBBlock(t *testing.T, data string, children ...blocks.Block) blocks.Block {
+	var node []byte
+	for i, c := range children {
+		hash := c.Cid().Bytes()
+		name := fmt.Sprintf("child%d", i)
+		link := append([]byte{0x0a, byte(len(hash))}, hash...)
+		link = append(link, 0x12, byte(len(name)))
+		link = append(link, name...)
+		link = append(link, 0x18, byte(len(c.RawData())))
+		node = append(node, 0x12, byte(len(link)))
+		node = append(node, link...)
+	}
+	node = append(node, 0x0a, byte(len(data)))
+	node = append(node, data...)
+	c, err := cid.NewPrefixV0(mh.SHA2_256).Sum(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := blocks.NewBlockWithCid(node, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestDecodeDagPB(t *testing.T) {
+	child := blocks.NewBlock([]byte("child"))
+	b := newDagPBBlock(t, "data", child)
+
+	ks := links(defaultDecoder, b)
+	if len(ks) != 1 || ks[0] != child.Cid() {
+		t.Fatalf("expected a link to %s, got %v", child.Cid(), ks)
+	}
+	if ks := links(defaultDecoder, child); len(ks) != 0 {
+		t.Fatalf("expected no links in a raw block, got %v", ks)
+	}
+}
+
+func TestPrefetchDagPB(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfLocalIpfs.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(exchbstore))
+
+	leaf := blocks.NewBlock([]byte("leaf"))
+	dir := newDagPBBlock(t, "dir", leaf)
+	root := newDagPBBlock(t, "root", dir)
+	dag := []blocks.Block{root, dir, leaf}
+	if err := exchbstore.PutMany(ctx, dag); err != nil {
+		t.Fatal(err)
+	}
+
+	// no Decoder: dag-pb links must be followed out of the box
+	if err := Prefetch(ctx, bserv, root.Cid(), PrefetchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range dag {
+		has, err := bstore.Has(ctx, b.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !has {
+			t.Fatalf("block %d was not prefetched", i)
+		}
+	}
+}
+
+func TestExportCAR(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfLocalIpfs.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(exchbstore))
+
+	dag := newTestDAG(t)
+	if err := exchbstore.PutMany(ctx, dag); err != nil {
+		t.Fatal(err)
+	}
+	root := dag[0].Cid()
+
+	for _, tc := range []struct {
+		name string
+		opts ExportOptions
+		want []int
+	}{
+		{"breadth first v1", ExportOptions{Decoder: linkDecoder{}}, []int{0, 1, 2, 3, 4, 5, 6}},
+		{"depth first v2", ExportOptions{Version: 2, Order: DepthFirst, Decoder: linkDecoder{}}, []int{0, 1, 3, 4, 2, 5, 6}},
+		{"max depth", ExportOptions{MaxDepth: 1, Decoder: linkDecoder{}}, []int{0, 1, 2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := ExportCAR(ctx, bserv, []cid.Cid{root}, &buf, tc.opts); err != nil {
+				t.Fatal(err)
+			}
+			cr, err := car.NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cr.Roots) != 1 || cr.Roots[0] != root {
+				t.Fatalf("unexpected roots %v", cr.Roots)
+			}
+			for _, i := range tc.want {
+				b, err := cr.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b.Cid() != dag[i].Cid() {
+					t.Fatalf("expected block %d (%s), got %s", i, dag[i].Cid(), b.Cid())
+				}
+			}
+			if _, err := cr.Next(); err != io.EOF {
+				t.Fatalf("expected io.EOF, got %v", err)
+			}
+		})
+	}
+
+	if err := exchbstore.DeleteBlock(ctx, dag[6].Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if err := bstore.DeleteBlock(ctx, dag[6].Cid()); err != nil {
+		t.Fatal(err)
+	}
+	err := ExportCAR(ctx, bserv, []cid.Cid{root}, io.Discard, ExportOptions{Decoder: linkDecoder{}})
+	if !ipld.IsNotFound(err) {
+		t.Fatalf("expected a not found error for the missing leaf, got %v", err)
+	}
+}
+
+func TestExportCARDagPB(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfLocalIpfs.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil)
+
+	leaf := blocks.NewBlock([]byte("leaf"))
+	dir := newDagPBBlock(t, "dir", leaf)
+	root := newDagPBBlock(t, "root", dir)
+	dag := []blocks.Block{root, dir, leaf}
+	if err := bstore.PutMany(ctx, dag); err != nil {
+		t.Fatal(err)
+	}
+
+	// no Decoder: dag-pb links must be followed out of the box
+	var buf bytes.Buffer
+	if err := ExportCAR(ctx, bserv, []cid.Cid{root.Cid()}, &buf, ExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	cr, err := car.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range dag {
+		b, err := cr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Cid() != want.Cid() {
+			t.Fatalf("expected block %d (%s), got %s", i, want.Cid(), b.Cid())
+		}
+	}
+	if _, err := cr.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestImportCAR(t *testing.T) {
+	ctx := context.Background()
+
+	dag := newTestDAG(t)
+	var buf bytes.Buffer
+	cw, err := car.NewWriter(&buf, []cid.Cid{dag[0].Cid()}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// repeated blocks, within a batch and across batches, count once
+	written := append([]blocks.Block{dag[0], dag[1], dag[1]}, dag[2:]...)
+	written = append(written, dag[2])
+	for _, b := range written {
+		if err := cw.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exch := &notifyCountingExchange{offline.Exchange(bstore), 0}
+	bserv := New(bstore, exch)
+	if err := bstore.Put(ctx, dag[3]); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := ImportCAR(ctx, bserv, &buf, ImportOptions{BatchSize: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Roots) != 1 || res.Roots[0] != dag[0].Cid() {
+		t.Fatalf("unexpected roots %v", res.Roots)
+	}
+	if res.New != len(dag)-1 || res.Present != 1 {
+		t.Fatalf("expected %d new and 1 present blocks, got %d and %d", len(dag)-1, res.New, res.Present)
+	}
+	for _, b := range dag {
+		if has, err := bstore.Has(ctx, b.Cid()); err != nil || !has {
+			t.Fatalf("block %s was not imported", b.Cid())
+		}
+	}
+	if exch.notifyCount != len(dag)-1 {
+		t.Fatalf("expected the exchange to be told about %d blocks, got %d", len(dag)-1, exch.notifyCount)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfOnlyIpfs.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	if err := exchbstore.Put(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+
+	failFast := New(bstore, offline.Exchange(exchbstore), WithRateLimit(SourceIpfs, RateLimit{
+		RequestsPerSecond: 1,
+		Policy:            RateLimitFailFast,
+	}))
+	if _, err := failFast.GetBlock(ctx, block.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := failFast.GetBlock(ctx, block.Cid()); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+
+	// batches larger than the burst go through on an idle service
+	var ks []cid.Cid
+	for i := 0; i < 3; i++ {
+		b := bgen.Next()
+		if err := exchbstore.Put(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, b.Cid())
+	}
+	batched := New(bstore, offline.Exchange(exchbstore), WithRateLimit(SourceIpfs, RateLimit{
+		RequestsPerSecond: 1,
+		RequestBurst:      2,
+		Policy:            RateLimitFailFast,
+	}))
+	received := 0
+	for range batched.GetBlocks(ctx, ks) {
+		received++
+	}
+	if received != len(ks) {
+		t.Fatalf("expected %d blocks, got %d", len(ks), received)
+	}
+	if _, err := batched.GetBlock(ctx, block.Cid()); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected the overdrawn budget to fail requests, got %v", err)
+	}
+
+	wait := New(bstore, offline.Exchange(exchbstore), WithRateLimit(SourceIpfs, RateLimit{
+		RequestsPerSecond: 20,
+		RequestBurst:      1,
+	}))
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := wait.GetBlock(ctx, block.Cid()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Fatalf("expected requests to be spread by the limit, took %s", d)
+	}
+
+	// local reads are never limited
+	local := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfOnlyLocal.Uint8())
+	for i := 0; i < 3; i++ {
+		if _, err := failFast.GetBlock(local, block.Cid()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+type priorityExchange struct {
+	exchange.Interface
+	lk         sync.Mutex
+	priorities []Priority
+}
+
+func (e *priorityExchange) GetBlockWithPriority(ctx context.Context, c cid.Cid, p Priority) (blocks.Block, error) {
+	e.lk.Lock()
+	e.priorities = append(e.priorities, p)
+	e.lk.Unlock()
+	return e.GetBlock(ctx, c)
+}
+
+func (e *priorityExchange) GetBlocksWithPriority(ctx context.Context, ks []cid.Cid, p Priority) (<-chan blocks.Block, error) {
+	e.lk.Lock()
+	e.priorities = append(e.priorities, p)
+	e.lk.Unlock()
+	return e.GetBlocks(ctx, ks)
+}
+
+func TestPriorityFetcher(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfOnlyIpfs.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exch := &priorityExchange{Interface: offline.Exchange(exchbstore)}
+	bserv := New(bstore, exch)
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+	if err := exchbstore.Put(ctx, block); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bserv.GetBlock(WithPriority(ctx, PriorityHigh), block.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	for range bserv.GetBlocks(WithPriority(ctx, PriorityBackground), []cid.Cid{block.Cid()}) {
+	}
+	if len(exch.priorities) != 2 || exch.priorities[0] != PriorityHigh || exch.priorities[1] != PriorityBackground {
+		t.Fatalf("unexpected priorities passed to the exchange: %v", exch.priorities)
+	}
+}
+
+func TestFetchQueueOrder(t *testing.T) {
+	ctx := context.Background()
+	q := newFetchQueue(1)
+
+	hold, err := q.acquire(ctx, PriorityNormal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lk sync.Mutex
+	var order []Priority
+	var wg sync.WaitGroup
+	for _, p := range []Priority{PriorityBackground, PriorityNormal, PriorityHigh} {
+		wg.Add(1)
+		go func(p Priority) {
+			defer wg.Done()
+			q.do(ctx, p, func(context.Context) error {
+				lk.Lock()
+				order = append(order, p)
+				lk.Unlock()
+				return nil
+			})
+		}(p)
+		// let each fetch queue up before the next one
+		time.Sleep(10 * time.Millisecond)
+	}
+	q.release(hold)
+	wg.Wait()
+
+	expected := []Priority{PriorityHigh, PriorityNormal, PriorityBackground}
+	for i, p := range expected {
+		if order[i] != p {
+			t.Fatalf("expected fetches in order %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestFetchQueuePreemption(t *testing.T) {
+	ctx := context.Background()
+	q := newFetchQueue(1)
+
+	started := make(chan struct{}, 2)
+	runs := 0
+	done := make(chan error)
+	go func() {
+		done <- q.do(ctx, PriorityBackground, func(ctx context.Context) error {
+			runs++
+			started <- struct{}{}
+			if runs > 1 {
+				return nil
+			}
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}()
+	<-started
+
+	if err := q.do(ctx, PriorityHigh, func(context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected the preempted fetch to run again, got %v", err)
+	}
+	if runs != 2 {
+		t.Fatalf("expected the background fetch to run twice, ran %d times", runs)
+	}
+
+	// a fetch preempted after it succeeded is not run again
+	runs = 0
+	started = make(chan struct{}, 1)
+	preempted := make(chan struct{})
+	go func() {
+		done <- q.do(ctx, PriorityBackground, func(fctx context.Context) error {
+			runs++
+			if runs > 1 {
+				return nil
+			}
+			started <- struct{}{}
+			<-fctx.Done()
+			<-preempted
+			return nil
+		})
+	}()
+	<-started
+	high := make(chan error)
+	go func() {
+		high <- q.do(ctx, PriorityHigh, func(context.Context) error { return nil })
+	}()
+	close(preempted)
+	if err := <-done; err != nil || runs != 1 {
+		t.Fatalf("expected a single successful run, got %v after %d runs", err, runs)
+	}
+	if err := <-high; err != nil {
+		t.Fatal(err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	hold, _ := q.acquire(ctx, PriorityNormal)
+	cancel()
+	if _, err := q.acquire(cctx, PriorityNormal); err != context.Canceled {
+		t.Fatalf("expected a cancelled wait, got %v", err)
+	}
+	q.release(hold)
+	if len(q.waiting) != 0 || q.free != 1 {
+		t.Fatalf("expected the queue to be idle, %d waiting and %d free", len(q.waiting), q.free)
+	}
+}
+
+// stallingScheduler stalls its first download info request until the
+// caller gives up, then points every request at edgeURL.
+type stallingScheduler struct {
+	edgeURL string
+	started chan struct{}
+	calls   int32
+}
+
+func (s *stallingScheduler) GetDownloadInfoWithBlock(ctx context.Context, _, _ string) (api.DownloadInfo, error) {
+	if atomic.AddInt32(&s.calls, 1) == 1 {
+		close(s.started)
+		<-ctx.Done()
+		return api.DownloadInfo{}, ctx.Err()
+	}
+	return api.DownloadInfo{URL: s.edgeURL, Token: "token"}, nil
+}
+
+func TestTitanFetchPreemption(t *testing.T) {
+	bgen := butil.NewBlockGenerator()
+	background, urgent := bgen.Next(), bgen.Next()
+	served := map[string][]byte{
+		background.Cid().String(): background.RawData(),
+		urgent.Cid().String():     urgent.RawData(),
+	}
+	edge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(served[r.URL.Query().Get("cid")])
+	}))
+	defer edge.Close()
+	sched := &stallingScheduler{edgeURL: edge.URL, started: make(chan struct{})}
+	ctx := context.WithValue(withScheduler(t, sched), LoadLevelOfSign, LoadOfOnlyTitan.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithFetchConcurrency(1))
+
+	done := make(chan error)
+	go func() {
+		_, err := bserv.GetBlock(WithPriority(ctx, PriorityBackground), background.Cid())
+		done <- err
+	}()
+	<-sched.started
+
+	start := time.Now()
+	if _, err := bserv.GetBlock(ctx, urgent.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("the urgent fetch waited %s for the background one", d)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected the preempted titan fetch to run again, got %v", err)
+	}
+	if n := atomic.LoadInt32(&sched.calls); n != 3 {
+		t.Fatalf("expected 3 scheduler requests, got %d", n)
+	}
+}
+
+// stallingExchange stalls its first batch until the caller gives up, or
+// for 5s.
+type stallingExchange struct {
+	exchange.Interface
+	started chan struct{}
+	batches int32
+}
+
+func (e *stallingExchange) GetBlocks(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, error) {
+	if atomic.AddInt32(&e.batches, 1) > 1 {
+		return e.Interface.GetBlocks(ctx, ks)
+	}
+	close(e.started)
+	out := make(chan blocks.Block)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+		close(out)
+	}()
+	return out, nil
+}
+
+func TestBatchPreemption(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfOnlyIpfs.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exch := &stallingExchange{Interface: offline.Exchange(exchbstore), started: make(chan struct{})}
+	bserv := New(bstore, exch, WithFetchConcurrency(1))
+	bgen := butil.NewBlockGenerator()
+	var ks []cid.Cid
+	for i := 0; i < 3; i++ {
+		b := bgen.Next()
+		if err := exchbstore.Put(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, b.Cid())
+	}
+
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range bserv.GetBlocks(WithPriority(ctx, PriorityBackground), ks[1:]) {
+			n++
+		}
+		received <- n
+	}()
+	<-exch.started
+
+	if _, err := bserv.GetBlock(ctx, ks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-received; n != 2 {
+		t.Fatalf("expected the preempted batch to be fetched again, got %d blocks", n)
+	}
+	if n := atomic.LoadInt32(&exch.batches); n != 2 {
+		t.Fatalf("expected 2 batches, got %d", n)
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfLocalIpfs.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	m := newCountingMetrics()
+	bgen := butil.NewBlockGenerator()
+	blks := []blocks.Block{bgen.Next(), bgen.Next(), bgen.Next()}
+	size := len(blks[0].RawData())
+	bserv := New(bstore, offline.Exchange(exchbstore), WithMetrics(m), WithMemoryCache(2*size))
+
+	if err := exchbstore.Put(ctx, blks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bserv.GetBlock(ctx, blks[0].Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if m.misses[SourceMemory] != 1 || m.hits[SourceIpfs] != 1 {
+		t.Fatalf("expected a memory miss resolved by ipfs: %+v", m)
+	}
+
+	// served from memory even once gone from the blockstore
+	if err := bstore.DeleteBlock(ctx, blks[0].Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bserv.GetBlock(ctx, blks[0].Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if m.hits[SourceMemory] != 1 || m.requested[SourceLocal] != 1 {
+		t.Fatalf("expected a memory hit: %+v", m)
+	}
+
+	// local hits fill the cache, evicting the least recently used block
+	for _, b := range blks[1:] {
+		if err := bstore.Put(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bserv.GetBlock(ctx, b.Cid()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	local := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfOnlyLocal.Uint8())
+	if _, err := bserv.GetBlock(local, blks[0].Cid()); err == nil {
+		t.Fatal("expected the first block to have been evicted")
+	}
+
+	if err := bserv.DeleteBlock(ctx, blks[2].Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := bserv.Has(ctx, blks[2].Cid()); err != nil || has {
+		t.Fatalf("expected deleted block to be dropped from memory, has=%v err=%v", has, err)
+	}
+}
+
+func TestFetchCache(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfLocalIpfs.Uint8())
+	local := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfOnlyLocal.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	cstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bgen := butil.NewBlockGenerator()
+	blks := []blocks.Block{bgen.Next(), bgen.Next(), bgen.Next()}
+	size := len(blks[0].RawData())
+	for _, b := range blks {
+		if err := exchbstore.Put(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bserv := New(bstore, offline.Exchange(exchbstore), WithFetchCache(cstore, FetchCacheOptions{MaxBytes: int64(2 * size)}))
+	if _, err := bserv.GetBlock(ctx, blks[0].Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bstore.Has(ctx, blks[0].Cid()); has {
+		t.Fatal("expected fetched block to stay out of the primary blockstore")
+	}
+	if has, _ := cstore.Has(ctx, blks[0].Cid()); !has {
+		t.Fatal("expected fetched block in the fetch cache")
+	}
+	if _, err := bserv.GetBlock(local, blks[0].Cid()); err != nil {
+		t.Fatalf("expected local reads to consult the fetch cache: %s", err)
+	}
+
+	added := bgen.Next()
+	if err := bserv.AddBlock(ctx, added); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bstore.Has(ctx, added.Cid()); !has {
+		t.Fatal("expected added block in the primary blockstore")
+	}
+
+	for range bserv.GetBlocks(ctx, []cid.Cid{blks[1].Cid(), blks[2].Cid()}) {
+	}
+	if has, _ := cstore.Has(ctx, blks[0].Cid()); has {
+		t.Fatal("expected least recently used block to be evicted")
+	}
+	if size, err := bserv.GetSize(local, blks[2].Cid()); err != nil || size != len(blks[2].RawData()) {
+		t.Fatalf("unexpected size %d from the fetch cache: %v", size, err)
+	}
+
+	// blocks left by a previous run are indexed and expire
+	reopened := New(bstore, nil, WithFetchCache(cstore, FetchCacheOptions{TTL: 20 * time.Millisecond}))
+	<-reopened.(*blockService).fetched.ready
+	if has, err := reopened.Has(local, blks[1].Cid()); err != nil || !has {
+		t.Fatalf("expected indexed block, has=%v err=%v", has, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := reopened.GetBlock(local, blks[1].Cid()); !ipld.IsNotFound(err) {
+		t.Fatalf("expected expired block to be gone, got %v", err)
+	}
+	if has, _ := cstore.Has(ctx, blks[1].Cid()); has {
+		t.Fatal("expected expired block to be deleted")
+	}
+}
+
+// slowIndexBlockstore lists its keys only once release is closed.
+type slowIndexBlockstore struct {
+	blockstore.Blockstore
+	release chan struct{}
+}
+
+func (bs *slowIndexBlockstore) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	select {
+	case <-bs.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return bs.Blockstore.AllKeysChan(ctx)
+}
+
+func TestFetchCacheIndexing(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfLocalIpfs.Uint8())
+	local := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfOnlyLocal.Uint8())
+	bgen := butil.NewBlockGenerator()
+	cached, fetched := bgen.Next(), bgen.Next()
+
+	cstore := &slowIndexBlockstore{
+		Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore())),
+		release:    make(chan struct{}),
+	}
+	if err := cstore.Put(ctx, cached); err != nil {
+		t.Fatal(err)
+	}
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	if err := exchbstore.Put(ctx, fetched); err != nil {
+		t.Fatal(err)
+	}
+	exch := &notifyCountingExchange{Interface: offline.Exchange(exchbstore)}
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, exch, WithFetchCache(cstore, FetchCacheOptions{}))
+
+	// requests don't wait for the index
+	dctx, cancel := context.WithTimeout(local, time.Second)
+	defer cancel()
+	if _, err := bserv.GetBlock(dctx, cached.Cid()); err != nil {
+		t.Fatalf("expected the cached block before indexing completes: %s", err)
+	}
+
+	// blocks only in the fetch cache are not announced
+	if _, err := bserv.GetBlock(ctx, fetched.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if exch.notifyCount != 0 {
+		t.Fatalf("expected no announcement of cache-only blocks, got %d", exch.notifyCount)
+	}
+
+	close(cstore.release)
+	<-bserv.(*blockService).fetched.ready
+	if has, err := bserv.Has(local, cached.Cid()); err != nil || !has {
+		t.Fatalf("expected indexed block, has=%v err=%v", has, err)
+	}
+	if err := bserv.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type batchRecordingBlockstore struct {
+	blockstore.Blockstore
+	lk      sync.Mutex
+	batches []int
+}
+
+func (bs *batchRecordingBlockstore) Put(ctx context.Context, b blocks.Block) error {
+	return bs.PutMany(ctx, []blocks.Block{b})
+}
+
+func (bs *batchRecordingBlockstore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	bs.lk.Lock()
+	bs.batches = append(bs.batches, len(blks))
+	bs.lk.Unlock()
+	return bs.Blockstore.PutMany(ctx, blks)
+}
+
+// chanExchange serves GetBlocks from a channel fed by the test.
+type chanExchange struct {
+	exchange.Interface
+	blocks chan blocks.Block
+}
+
+func (e *chanExchange) GetBlocks(ctx context.Context, ks []cid.Cid) (<-chan blocks.Block, error) {
+	return e.blocks, nil
+}
+
+func TestWriteBatching(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfOnlyIpfs.Uint8())
+
+	bstore := &batchRecordingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bgen := butil.NewBlockGenerator()
+	var ks []cid.Cid
+	for i := 0; i < 5; i++ {
+		b := bgen.Next()
+		if err := exchbstore.Put(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, b.Cid())
+	}
+
+	bserv := New(bstore, offline.Exchange(exchbstore), WithWriteBatching(2, time.Hour))
+	received := 0
+	for range bserv.GetBlocks(ctx, ks) {
+		received++
+	}
+	if received != len(ks) {
+		t.Fatalf("expected %d blocks, got %d", len(ks), received)
+	}
+	if len(bstore.batches) != 3 || bstore.batches[0] != 2 || bstore.batches[2] != 1 {
+		t.Fatalf("expected batches of 2, 2 and 1 blocks, got %v", bstore.batches)
+	}
+
+	// a partial batch is flushed after the max latency, while the stream
+	// is still open
+	exch := &chanExchange{Interface: offline.Exchange(exchbstore), blocks: make(chan blocks.Block)}
+	bstore = &batchRecordingBlockstore{Blockstore: blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	bserv = New(bstore, exch, WithWriteBatching(10, 20*time.Millisecond))
+	block := bgen.Next()
+	out := bserv.GetBlocks(ctx, []cid.Cid{block.Cid(), bgen.Next().Cid()})
+	exch.blocks <- block
+	if b := <-out; b.Cid() != block.Cid() {
+		t.Fatalf("expected block %s, got %s", block.Cid(), b.Cid())
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if has, _ := bstore.Has(ctx, block.Cid()); has {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the block to be written back after the max latency")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(exch.blocks)
+	for range out {
+	}
+}
+
+type failingPutBlockstore struct {
+	blockstore.Blockstore
+}
+
+func (bs *failingPutBlockstore) Put(context.Context, blocks.Block) error {
+	return errors.New("put failed")
+}
+
+func (bs *failingPutBlockstore) PutMany(context.Context, []blocks.Block) error {
+	return errors.New("put failed")
+}
+
+type failingNotifyExchange struct {
+	*chanExchange
+	notified chan struct{}
+}
+
+func (e *failingNotifyExchange) NotifyNewBlocks(context.Context, ...blocks.Block) error {
+	close(e.notified)
+	return errors.New("notify failed")
+}
+
+func TestForwardFetchedCancelMidBatch(t *testing.T) {
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exch := &notifyCountingExchange{Interface: offline.Exchange(bstore)}
+	l := loader{bs: bstore, metrics: noopMetrics{}, batchSize: 10, batchLatency: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan blocks.Block)
+	out := make(chan blocks.Block)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.forwardFetched(ctx, exch, in, out)
+	}()
+
+	bgen := butil.NewBlockGenerator()
+	delivered := []blocks.Block{bgen.Next(), bgen.Next()}
+	for _, b := range delivered {
+		in <- b
+		<-out
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the stage to stop once cancelled")
+	}
+
+	// the partial batch delivered before cancellation is still written
+	for _, b := range delivered {
+		if has, _ := bstore.Has(context.Background(), b.Cid()); !has {
+			t.Fatalf("expected delivered block %s to be written back", b.Cid())
+		}
+	}
+	if exch.notifyCount != len(delivered) {
+		t.Fatalf("expected %d notified blocks, got %d", len(delivered), exch.notifyCount)
+	}
+}
+
+func TestForwardFetchedPutFailure(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfOnlyIpfs.Uint8())
+
+	bstore := &failingPutBlockstore{blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	exch := &chanExchange{Interface: offline.Exchange(bstore), blocks: make(chan blocks.Block)}
+	bserv := New(bstore, exch, WithWriteBatching(1, time.Hour))
+	bgen := butil.NewBlockGenerator()
+	first, second := bgen.Next(), bgen.Next()
+
+	out := bserv.GetBlocks(ctx, []cid.Cid{first.Cid(), second.Cid()})
+	exch.blocks <- first
+	if b := <-out; b.Cid() != first.Cid() {
+		t.Fatalf("expected block %s, got %s", first.Cid(), b.Cid())
+	}
+	// the failed write ends the request
+	select {
+	case b, ok := <-out:
+		if ok {
+			t.Fatalf("expected no block after the failed write, got %s", b.Cid())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the request to end after the failed write")
+	}
+}
+
+func TestForwardFetchedNotifyFailure(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfOnlyIpfs.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exch := &failingNotifyExchange{
+		chanExchange: &chanExchange{Interface: offline.Exchange(bstore), blocks: make(chan blocks.Block)},
+		notified:     make(chan struct{}),
+	}
+	bserv := New(bstore, exch, WithWriteBatching(1, time.Hour))
+	bgen := butil.NewBlockGenerator()
+	first, second := bgen.Next(), bgen.Next()
+
+	out := bserv.GetBlocks(ctx, []cid.Cid{first.Cid(), second.Cid()})
+	exch.blocks <- first
+	<-out
+	<-exch.notified
+	select {
+	case b, ok := <-out:
+		if ok {
+			t.Fatalf("expected no block after the failed notify, got %s", b.Cid())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the request to end after the failed notify")
+	}
+	if has, _ := bstore.Has(ctx, first.Cid()); !has {
+		t.Fatal("expected the block to be written before the exchange was notified")
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfOnlyIpfs.Uint8())
+
+	bstore := &failingPutBlockstore{blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))}
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bgen := butil.NewBlockGenerator()
+	var ks []cid.Cid
+	for i := 0; i < 3; i++ {
+		b := bgen.Next()
+		if err := exchbstore.Put(ctx, b); err != nil {
+			t.Fatal(err)
+		}
+		ks = append(ks, b.Cid())
+	}
+
+	strict := New(bstore, offline.Exchange(exchbstore))
+	if _, err := strict.GetBlock(ctx, ks[0]); err == nil {
+		t.Fatal("expected the failed write to fail the request")
+	}
+
+	m := newCountingMetrics()
+	o := &recordingObserver{fetched: make(map[cid.Cid]Source), failed: make(map[cid.Cid]Source)}
+	bestEffort := New(bstore, offline.Exchange(exchbstore),
+		WithCachePolicy(CacheBestEffort), WithMetrics(m), WithObserver(o), WithWriteBatching(1, time.Hour))
+	if _, err := bestEffort.GetBlock(ctx, ks[0]); err != nil {
+		t.Fatalf("expected the block despite the failed write: %s", err)
+	}
+	received := 0
+	for range bestEffort.GetBlocks(ctx, ks) {
+		received++
+	}
+	if received != len(ks) {
+		t.Fatalf("expected %d blocks despite the failed writes, got %d", len(ks), received)
+	}
+	if m.failed != 1+len(ks) || len(o.unsaved) != 1+len(ks) {
+		t.Fatalf("expected %d failed writes to be reported, got %d metrics and %d hooks", 1+len(ks), m.failed, len(o.unsaved))
+	}
+}
+
+func TestGetBlocksOrdered(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfLocalIpfs.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, offline.Exchange(exchbstore), WithReorderWindow(2))
+	bgen := butil.NewBlockGenerator()
+
+	var ks []cid.Cid
+	missing := make(map[int]bool)
+	for i := 0; i < 7; i++ {
+		b := bgen.Next()
+		ks = append(ks, b.Cid())
+		switch i % 3 {
+		case 0:
+			if err := bstore.Put(ctx, b); err != nil {
+				t.Fatal(err)
+			}
+		case 1:
+			if err := exchbstore.Put(ctx, b); err != nil {
+				t.Fatal(err)
+			}
+		default:
+			missing[i] = true
+		}
+	}
+
+	for _, bg := range []OrderedGetter{bserv.(OrderedGetter), NewSession(ctx, bserv)} {
+		i := 0
+		for r := range bg.GetBlocksOrdered(ctx, ks) {
+			if r.Cid != ks[i] {
+				t.Fatalf("expected %s at position %d, got %s", ks[i], i, r.Cid)
+			}
+			if missing[i] != (r.Err != nil) || (r.Err == nil && r.Block.Cid() != ks[i]) {
+				t.Fatalf("unexpected result at position %d: %+v", i, r)
+			}
+			i++
+		}
+		if i != len(ks) {
+			t.Fatalf("expected %d results, got %d", len(ks), i)
+		}
+	}
+}
+
+func TestGetBlocksStream(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfLocalIpfs.Uint8())
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exch := &fakeSessionExchange{Interface: offline.Exchange(exchbstore), session: offline.Exchange(exchbstore)}
+	bserv := New(bstore, exch, WithStreamConcurrency(2)).(StreamGetter)
+	bgen := butil.NewBlockGenerator()
+
+	local, remote, missing := bgen.Next(), bgen.Next(), bgen.Next()
+	if err := bstore.Put(ctx, local); err != nil {
+		t.Fatal(err)
+	}
+	if err := exchbstore.Put(ctx, remote); err != nil {
+		t.Fatal(err)
+	}
+
+	in := make(chan cid.Cid)
+	out := bserv.GetBlocksStream(ctx, in)
+	go func() {
+		defer close(in)
+		for _, c := range []cid.Cid{local.Cid(), remote.Cid(), missing.Cid()} {
+			in <- c
+		}
+	}()
+
+	results := make(map[cid.Cid]Result)
+	for r := range out {
+		results[r.Cid] = r
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for _, b := range []blocks.Block{local, remote} {
+		if r := results[b.Cid()]; r.Err != nil || r.Block.Cid() != b.Cid() {
+			t.Fatalf("unexpected result for %s: %+v", b.Cid(), r)
+		}
+	}
+	if results[missing.Cid()].Err == nil {
+		t.Fatal("expected an error for the missing block")
+	}
+
+	// the channel closes early once the context is done
+	cctx, cancel := context.WithCancel(ctx)
+	out = bserv.GetBlocksStream(cctx, make(chan cid.Cid))
+	cancel()
+	select {
+	case _, ok := <-out:
+		if ok {
+			t.Fatal("expected no result")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the stream to close once cancelled")
+	}
+}
+
+func TestClose(t *testing.T) {
+	ctx := context.Background()
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil)
+	ses := NewSession(ctx, bserv)
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+
+	for i := 0; i < 2; i++ {
+		if err := bserv.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bserv.AddBlock(ctx, block); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, err := bserv.GetBlock(ctx, block.Cid()); err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, err := ses.GetBlock(ctx, block.Cid()); err != ErrClosed {
+		t.Fatalf("expected ErrClosed from the session, got %v", err)
+	}
+	if _, ok := <-bserv.GetBlocks(ctx, []cid.Cid{block.Cid()}); ok {
+		t.Fatal("expected a closed channel")
+	}
+	if r := bserv.(BlocksDeleter).DeleteBlocks(ctx, []cid.Cid{block.Cid()}); r[0].Err != ErrClosed {
+		t.Fatalf("expected ErrClosed, got %v", r[0].Err)
+	}
+}
+
+func TestCloseDrainsInFlight(t *testing.T) {
+	ctx := context.WithValue(context.Background(), LoadLevelOfSign, LoadOfOnlyIpfs.Uint8())
+	bgen := butil.NewBlockGenerator()
+
+	// requests finishing within the timeout complete
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exch := &chanExchange{Interface: offline.Exchange(bstore), blocks: make(chan blocks.Block)}
+	bserv := New(bstore, exch, WithCloseTimeout(time.Second), WithWriteBatching(10, time.Hour))
+	block := bgen.Next()
+	out := bserv.GetBlocks(ctx, []cid.Cid{block.Cid()})
+	closed := make(chan error)
+	go func() {
+		closed <- bserv.Close()
+	}()
+	exch.blocks <- block
+	if b := <-out; b == nil || b.Cid() != block.Cid() {
+		t.Fatal("expected the in-flight request to be served")
+	}
+	close(exch.blocks)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := bstore.Has(ctx, block.Cid()); !has {
+		t.Fatal("expected the pending write-back to be flushed by Close")
+	}
+
+	// the others are cancelled at the deadline, keeping what was delivered
+	bstore = blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exch = &chanExchange{Interface: offline.Exchange(bstore), blocks: make(chan blocks.Block)}
+	bserv = New(bstore, exch, WithCloseTimeout(20*time.Millisecond), WithWriteBatching(10, time.Hour))
+	block = bgen.Next()
+	out = bserv.GetBlocks(ctx, []cid.Cid{block.Cid(), bgen.Next().Cid()})
+	exch.blocks <- block
+	<-out
+	if err := bserv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-out; ok {
+		t.Fatal("expected the cancelled request to be over")
+	}
+	if has, _ := bstore.Has(ctx, block.Cid()); !has {
+		t.Fatal("expected the delivered block to be written back")
+	}
+}
+
+func TestCloseCancelsTitan(t *testing.T) {
+	ctx := context.WithValue(withHangingScheduler(t), LoadLevelOfSign, LoadOfOnlyTitan.Uint8())
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bserv := New(bstore, nil, WithCloseTimeout(0))
+	bgen := butil.NewBlockGenerator()
+	block := bgen.Next()
+
+	got := make(chan error)
+	go func() {
+		_, err := bserv.GetBlock(ctx, block.Cid())
+		got <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if err := bserv.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-got; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the titan lookup to be cancelled, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("closing took %s", d)
+	}
+}
+
+func TestOfflineLevels(t *testing.T) {
+	ctx := context.Background()
+	bgen := butil.NewBlockGenerator()
+	local, remote := bgen.Next(), bgen.Next()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	if err := bstore.Put(ctx, local); err != nil {
+		t.Fatal(err)
+	}
+	bserv := New(bstore, nil)
+
+	// without titan schedulers nor an exchange the default level only reads
+	// the blockstore
+	if _, err := bserv.GetBlock(ctx, local.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bserv.GetBlock(ctx, remote.Cid()); !ipld.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	onlyIpfs := context.WithValue(ctx, LoadLevelOfSign, LoadOfOnlyIpfs.Uint8())
+	_, err := bserv.GetBlock(onlyIpfs, remote.Cid())
+	var oe *OfflineError
+	if !errors.Is(err, ErrOffline) || !errors.As(err, &oe) {
+		t.Fatalf("expected ErrOffline, got %v", err)
+	}
+	if len(oe.Unavailable) != 1 || oe.Unavailable[0] != SourceIpfs {
+		t.Fatalf("unexpected unavailable sources %v", oe.Unavailable)
+	}
+	if _, ok := <-bserv.GetBlocks(onlyIpfs, []cid.Cid{remote.Cid()}); ok {
+		t.Fatal("expected a closed channel")
+	}
+
+	strict := New(bstore, nil, WithOfflineDegrade(false))
+	if _, err := strict.GetBlock(ctx, local.Cid()); !errors.Is(err, ErrOffline) {
+		t.Fatalf("expected ErrOffline without degradation, got %v", err)
+	}
+	localOnly := context.WithValue(ctx, LoadLevelOfSign, LoadOfOnlyLocal.Uint8())
+	if _, err := strict.GetBlock(localOnly, local.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	// attaching an exchange brings ipfs back
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	if err := exchbstore.Put(ctx, remote); err != nil {
+		t.Fatal(err)
+	}
+	exch := offline.Exchange(exchbstore)
+	if old := bserv.(ExchangeSetter).SetExchange(exch); old != nil {
+		t.Fatalf("expected no previous exchange, got %v", old)
+	}
+	if bserv.Exchange() != exch {
+		t.Fatal("exchange not attached")
+	}
+	if _, err := bserv.GetBlock(onlyIpfs, remote.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if old := bserv.(ExchangeSetter).SetExchange(nil); old != exch {
+		t.Fatal("expected the attached exchange back")
+	}
+}
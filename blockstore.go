@@ -0,0 +1,56 @@
+package blockservice
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+// AsBlockstore returns a blockstore.Blockstore backed by bs. Reads go through
+// the load level found in the request context, so blocks missing locally
+// are looked up on titan or the exchange as configured. Writes and deletes
+// go through AddBlock(s) and DeleteBlock, key listing and HashOnRead are
+// served by the underlying blockstore.
+func AsBlockstore(bs BlockService) blockstore.Blockstore {
+	return &blockstoreAdapter{bs: bs}
+}
+
+type blockstoreAdapter struct {
+	bs BlockService
+}
+
+var _ blockstore.Blockstore = (*blockstoreAdapter)(nil)
+
+func (a *blockstoreAdapter) DeleteBlock(ctx context.Context, c cid.Cid) error {
+	return a.bs.DeleteBlock(ctx, c)
+}
+
+func (a *blockstoreAdapter) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	return a.bs.Has(ctx, c)
+}
+
+func (a *blockstoreAdapter) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	return a.bs.GetBlock(ctx, c)
+}
+
+func (a *blockstoreAdapter) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	return a.bs.GetSize(ctx, c)
+}
+
+func (a *blockstoreAdapter) Put(ctx context.Context, blk blocks.Block) error {
+	return a.bs.AddBlock(ctx, blk)
+}
+
+func (a *blockstoreAdapter) PutMany(ctx context.Context, blks []blocks.Block) error {
+	return a.bs.AddBlocks(ctx, blks)
+}
+
+func (a *blockstoreAdapter) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	return a.bs.Blockstore().AllKeysChan(ctx)
+}
+
+func (a *blockstoreAdapter) HashOnRead(enabled bool) {
+	a.bs.Blockstore().HashOnRead(enabled)
+}
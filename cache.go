@@ -0,0 +1,105 @@
+package blockservice
+
+import (
+	"container/list"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// WithMemoryCache keeps up to maxBytes of recently used block data in
+// memory, evicting the least recently used blocks first. The cache is
+// consulted before the local blockstore by every load level reading from
+// local storage, and filled with the blocks found locally, on titan or
+// through the exchange. Lookups are recorded as SourceMemory metrics.
+//
+// Blocks deleted through the BlockService are dropped from the cache,
+// blocks deleted directly from the blockstore are served until evicted.
+func WithMemoryCache(maxBytes int) Option {
+	return func(s *blockService) {
+		s.cache = newMemoryCache(maxBytes)
+	}
+}
+
+// memoryCache is an LRU of blocks bounded by the size of their data.
+type memoryCache struct {
+	lk    sync.Mutex
+	max   int
+	size  int
+	ll    *list.List
+	items map[cid.Cid]*list.Element
+}
+
+func newMemoryCache(maxBytes int) *memoryCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &memoryCache{max: maxBytes, ll: list.New(), items: make(map[cid.Cid]*list.Element)}
+}
+
+func (m *memoryCache) get(c cid.Cid) (blocks.Block, bool) {
+	if m == nil {
+		return nil, false
+	}
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	e, ok := m.items[c]
+	if !ok {
+		return nil, false
+	}
+	m.ll.MoveToFront(e)
+	return e.Value.(blocks.Block), true
+}
+
+func (m *memoryCache) has(c cid.Cid) bool {
+	if m == nil {
+		return false
+	}
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	_, ok := m.items[c]
+	return ok
+}
+
+func (m *memoryCache) add(blks ...blocks.Block) {
+	if m == nil {
+		return
+	}
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	for _, b := range blks {
+		size := len(b.RawData())
+		if size > m.max {
+			continue
+		}
+		if e, ok := m.items[b.Cid()]; ok {
+			m.ll.MoveToFront(e)
+			continue
+		}
+		m.items[b.Cid()] = m.ll.PushFront(b)
+		m.size += size
+		for m.size > m.max {
+			m.removeElement(m.ll.Back())
+		}
+	}
+}
+
+func (m *memoryCache) remove(ks ...cid.Cid) {
+	if m == nil {
+		return
+	}
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	for _, c := range ks {
+		if e, ok := m.items[c]; ok {
+			m.removeElement(e)
+		}
+	}
+}
+
+func (m *memoryCache) removeElement(e *list.Element) {
+	b := m.ll.Remove(e).(blocks.Block)
+	delete(m.items, b.Cid())
+	m.size -= len(b.RawData())
+}
@@ -0,0 +1,226 @@
+package blockservice
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ipfs/go-blockservice/internal"
+	"github.com/ipfs/go-blockservice/internal/car"
+)
+
+// TraversalOrder is the order in which ExportCAR walks a DAG.
+type TraversalOrder uint8
+
+const (
+	BreadthFirst TraversalOrder = iota // level by level, fetching each level concurrently
+	DepthFirst                         // links in order, one block at a time
+)
+
+// ExportOptions configures ExportCAR.
+type ExportOptions struct {
+	// Version is the CAR version to write, 1 (the default) or 2. CARv2
+	// output is buffered in memory unless the writer is an io.WriteSeeker.
+	Version int
+	// Order is the traversal order, BreadthFirst by default.
+	Order TraversalOrder
+	// MaxDepth limits how many levels of links below the roots are
+	// exported. Zero means no limit.
+	MaxDepth int
+	// Concurrency is the number of blocks requested at once by a breadth
+	// first traversal. Defaults to 32.
+	Concurrency int
+	// Decoder decodes blocks to discover their links. Defaults to
+	// a decoder handling dag-pb and raw blocks that leaves other codecs to
+	// ipld.DefaultBlockDecoder; blocks it can't decode are treated as
+	// leaves.
+	Decoder ipld.BlockDecoder
+}
+
+// ExportCAR writes the DAGs below roots to w as a CAR, fetching blocks
+// through a session of bs with the load level found in ctx, so missing
+// blocks are pulled from titan or the exchange as configured. Every block
+// is written once. ExportCAR fails if any block of the DAGs can't be found.
+func ExportCAR(ctx context.Context, bs BlockService, roots []cid.Cid, w io.Writer, opts ExportOptions) error {
+	ctx, span := internal.StartSpan(ctx, "ExportCAR", trace.WithAttributes(attribute.Int("Roots", len(roots))))
+	defer span.End()
+
+	version := opts.Version
+	if version == 0 {
+		version = 1
+	}
+	cw, err := car.NewWriter(w, roots, version)
+	if err != nil {
+		return err
+	}
+
+	ses := NewSession(ctx, bs)
+	walkOpts := PrefetchOptions{
+		MaxDepth:    opts.MaxDepth,
+		Concurrency: opts.Concurrency,
+		Decoder:     opts.Decoder,
+	}
+	switch opts.Order {
+	case BreadthFirst:
+		err = walkDAG(ctx, ses, roots, walkOpts, func(ks []cid.Cid, blks []blocks.Block) error {
+			// GetBlocks makes no ordering guarantees, write in request order
+			found := make(map[cid.Cid]blocks.Block, len(blks))
+			for _, b := range blks {
+				found[b.Cid()] = b
+			}
+			for _, c := range ks {
+				b, ok := found[c]
+				if !ok {
+					return ipld.ErrNotFound{Cid: c}
+				}
+				if err := cw.Put(b); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	case DepthFirst:
+		err = walkDAGDepthFirst(ctx, ses, roots, walkOpts, cw.Put)
+	default:
+		err = fmt.Errorf("unknown traversal order %d", opts.Order)
+	}
+	if err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+const defaultImportBatchSize = 32
+
+// ImportOptions configures ImportCAR.
+type ImportOptions struct {
+	// BatchSize is the number of blocks passed to AddBlocks at once.
+	// Defaults to 32.
+	BatchSize int
+}
+
+// ImportResult summarizes a CAR import. Blocks repeated in the CAR are
+// counted once.
+type ImportResult struct {
+	// Roots are the roots found in the CAR header.
+	Roots []cid.Cid
+	// New is the number of blocks that were not in the blockstore.
+	New int
+	// Present is the number of blocks that were already in the blockstore.
+	Present int
+}
+
+// ImportCAR reads a CARv1 stream or CARv2 file from r, checks that every
+// block hashes to its CID and adds the blocks to bs in batches through
+// AddBlocks, so the exchange is notified about them. On error, the result
+// covers the batches added so far.
+func ImportCAR(ctx context.Context, bs BlockService, r io.Reader, opts ImportOptions) (ImportResult, error) {
+	ctx, span := internal.StartSpan(ctx, "ImportCAR")
+	defer span.End()
+
+	var res ImportResult
+	cr, err := car.NewReader(r)
+	if err != nil {
+		return res, err
+	}
+	res.Roots = cr.Roots
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	seen := cid.NewSet()
+	batch := make([]blocks.Block, 0, batchSize)
+	for {
+		b, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+		if !seen.Visit(b.Cid()) {
+			continue
+		}
+		batch = append(batch, b)
+		if len(batch) == batchSize {
+			if err := addBatch(ctx, bs, batch, &res); err != nil {
+				return res, err
+			}
+			batch = make([]blocks.Block, 0, batchSize)
+		}
+	}
+	if len(batch) != 0 {
+		if err := addBatch(ctx, bs, batch, &res); err != nil {
+			return res, err
+		}
+	}
+	span.SetAttributes(attribute.Int("New", res.New), attribute.Int("Present", res.Present))
+	return res, nil
+}
+
+func addBatch(ctx context.Context, bs BlockService, batch []blocks.Block, res *ImportResult) error {
+	present := 0
+	for _, b := range batch {
+		has, err := bs.Blockstore().Has(ctx, b.Cid())
+		if err != nil {
+			return err
+		}
+		if has {
+			present++
+		}
+	}
+	if err := bs.AddBlocks(ctx, batch); err != nil {
+		return err
+	}
+	res.Present += present
+	res.New += len(batch) - present
+	return nil
+}
+
+// walkDAGDepthFirst fetches the DAGs below roots one block at a time,
+// visiting each block before its links.
+func walkDAGDepthFirst(ctx context.Context, bg BlockGetter, roots []cid.Cid, opts PrefetchOptions, visit func(blocks.Block) error) error {
+	dec := opts.Decoder
+	if dec == nil {
+		dec = defaultDecoder
+	}
+
+	seen := cid.NewSet()
+	var walk func(c cid.Cid, depth int) error
+	walk = func(c cid.Cid, depth int) error {
+		if !seen.Visit(c) {
+			return nil
+		}
+		b, err := bg.GetBlock(ctx, c)
+		if err != nil {
+			return err
+		}
+		if err := visit(b); err != nil {
+			return err
+		}
+		if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+			return nil
+		}
+		for _, l := range links(dec, b) {
+			if err := walk(l, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, c := range roots {
+		if err := walk(c, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
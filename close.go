@@ -0,0 +1,117 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+)
+
+// ErrClosed is returned by requests made after Close was called. Methods
+// returning channels return closed channels instead.
+var ErrClosed = errors.New("blockservice: closed")
+
+const defaultCloseTimeout = 5 * time.Second
+
+// WithCloseTimeout sets how long Close lets in-flight requests finish
+// before cancelling them, 5s by default. With 0 they are cancelled right
+// away.
+func WithCloseTimeout(d time.Duration) Option {
+	return func(s *blockService) {
+		s.closeTimeout = d
+	}
+}
+
+// lifecycle tracks the requests in flight so Close can drain or cancel
+// them. Sessions share the lifecycle of their service.
+type lifecycle struct {
+	lk       sync.Mutex
+	closed   bool
+	wg       sync.WaitGroup
+	requests map[*request]struct{}
+}
+
+type request struct {
+	cancel context.CancelFunc
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{requests: make(map[*request]struct{})}
+}
+
+// begin registers a request and returns its context along with the func
+// ending it, or a nil func once the service is closing.
+func (lc *lifecycle) begin(ctx context.Context) (context.Context, func()) {
+	if lc == nil {
+		return ctx, func() {}
+	}
+	lc.lk.Lock()
+	defer lc.lk.Unlock()
+	if lc.closed {
+		return ctx, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	r := &request{cancel: cancel}
+	lc.requests[r] = struct{}{}
+	lc.wg.Add(1)
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			cancel()
+			lc.lk.Lock()
+			delete(lc.requests, r)
+			lc.lk.Unlock()
+			lc.wg.Done()
+		})
+	}
+}
+
+// shutdown rejects new requests, waits up to timeout for the requests in
+// flight and cancels those still running. It returns once all of them
+// ended, their write-back included.
+func (lc *lifecycle) shutdown(timeout time.Duration) {
+	lc.lk.Lock()
+	lc.closed = true
+	lc.lk.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		lc.wg.Wait()
+		close(drained)
+	}()
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		select {
+		case <-drained:
+			return
+		case <-t.C:
+		}
+	}
+
+	lc.lk.Lock()
+	if n := len(lc.requests); n != 0 {
+		logger.Debugf("cancelling %d requests in flight", n)
+	}
+	for r := range lc.requests {
+		r.cancel()
+	}
+	lc.lk.Unlock()
+	<-drained
+}
+
+func closedBlocks() <-chan blocks.Block {
+	out := make(chan blocks.Block)
+	close(out)
+	return out
+}
+
+func closedResults() <-chan Result {
+	out := make(chan Result)
+	close(out)
+	return out
+}
@@ -0,0 +1,394 @@
+// Command blockservice fetches and inspects blocks through a blockservice
+// built over a local flatfs or badger blockstore, with titan as the remote
+// source.
+//
+//	blockservice [global flags] <command> [flags] [args]
+//
+// Command flags may also follow the arguments, as in
+// "blockservice get <cid> -level=local-titan", and global flags may also be
+// given after the command name.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-blockservice/titan"
+	cid "github.com/ipfs/go-cid"
+	badger "github.com/ipfs/go-ds-badger"
+	flatfs "github.com/ipfs/go-ds-flatfs"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+)
+
+const usage = `usage: blockservice [global flags] <command> [flags] [args]
+
+commands:
+  get <cid>           write the block data to stdout
+  has <cid>           report whether the block can be resolved
+  stat <cid>          print the block size and the source that served it
+  export-car <cid>... write the DAGs below the given roots as a CAR
+  import-car <file>   add the blocks of a CAR file
+  titan-probe <cid>   show how titan resolves a block
+
+global flags:
+`
+
+type command struct {
+	run   func(ctx context.Context, bs blockservice.BlockService, args []string) error
+	flags func(fs *flag.FlagSet)
+	// standalone commands don't use the blockservice and run with a nil
+	// one, so no blockstore is needed
+	standalone bool
+}
+
+var (
+	repo      string
+	datastore = "flatfs"
+	titanIps  = os.Getenv("TITAN_SCHEDULERS")
+
+	level    string
+	out      string
+	carV2    bool
+	depth    int
+	order    string
+	batch    int
+	deadline = time.Minute
+	asJSON   bool
+
+	// sources records the source serving each block of the command.
+	sources = &sourceRecorder{served: make(map[cid.Cid]blockservice.Source)}
+)
+
+func main() {
+	global := flag.NewFlagSet("blockservice", flag.ExitOnError)
+	globalFlags(global)
+	global.Usage = func() {
+		fmt.Fprint(global.Output(), usage)
+		global.PrintDefaults()
+	}
+	global.Parse(os.Args[1:])
+
+	if global.NArg() == 0 {
+		global.Usage()
+		os.Exit(2)
+	}
+
+	name, args := global.Arg(0), global.Args()[1:]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", name)
+		global.Usage()
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	globalFlags(fs)
+	fs.StringVar(&level, "level", blockservice.LoadOfLocalTitan.String(), "load level, one of "+loadLevels())
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+
+	if err := run(cmd, parseInterspersed(fs, args)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// globalFlags registers the flags accepted before and after the command
+// name. Their defaults are those of the global flag set, so parsing them
+// again after the command keeps the values given before it.
+func globalFlags(fs *flag.FlagSet) {
+	fs.StringVar(&repo, "repo", repo, "path of the blockstore")
+	fs.StringVar(&datastore, "datastore", datastore, "blockstore backend, flatfs or badger")
+	fs.StringVar(&titanIps, "titan", titanIps, "comma separated titan scheduler multiaddrs")
+	fs.DurationVar(&deadline, "timeout", deadline, "time allowed for the command")
+}
+
+// parseInterspersed parses the flags found anywhere in args, which the flag
+// package stops looking for at the first argument, and returns the
+// arguments. Everything after "--" is an argument.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		rest := fs.Args()
+		if consumed := args[:len(args)-len(rest)]; len(consumed) != 0 && consumed[len(consumed)-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			return positional
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+var commands = map[string]command{
+	"get": {run: get, flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&out, "out", "", "write to this file instead of stdout")
+	}},
+	"has":  {run: has},
+	"stat": {run: stat},
+	"export-car": {run: exportCar, flags: func(fs *flag.FlagSet) {
+		fs.StringVar(&out, "out", "", "write to this file instead of stdout")
+		fs.BoolVar(&carV2, "v2", false, "write a CARv2")
+		fs.IntVar(&depth, "depth", 0, "levels of links to follow, 0 for all")
+		fs.StringVar(&order, "order", "bfs", "traversal order, bfs or dfs")
+	}},
+	"import-car": {run: importCar, flags: func(fs *flag.FlagSet) {
+		fs.IntVar(&batch, "batch", 0, "blocks added at once")
+	}},
+	"titan-probe": {run: titanProbe, standalone: true, flags: func(fs *flag.FlagSet) {
+		fs.BoolVar(&asJSON, "json", false, "print the report as JSON")
+	}},
+}
+
+func run(cmd command, args []string) error {
+	loadLevel, err := blockservice.ParseLoadLevel(level)
+	if err != nil {
+		return err
+	}
+	switch loadLevel {
+	case blockservice.LoadOfLocalTitanIpfs, blockservice.LoadOfLocalIpfs, blockservice.LoadOfOnlyIpfs:
+		// offline degradation would quietly skip ipfs
+		return fmt.Errorf("load level %s needs an ipfs exchange, which this command does not have", loadLevel)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	ctx = context.WithValue(ctx, blockservice.LoadLevelOfSign, loadLevel.Uint8())
+	if titanIps != "" {
+		ctx = context.WithValue(ctx, "TitanIps", strings.Split(titanIps, ","))
+	}
+
+	if cmd.standalone {
+		return cmd.run(ctx, nil, args)
+	}
+
+	bstore, closer, err := openBlockstore()
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	// there is no libp2p host here, blocks come from local storage or titan
+	bs := blockservice.New(bstore, nil, blockservice.WithObserver(sources))
+	return cmd.run(ctx, bs, args)
+}
+
+func openBlockstore() (blockstore.Blockstore, io.Closer, error) {
+	if repo == "" {
+		return nil, nil, errors.New("a blockstore path is required, see -repo")
+	}
+
+	switch datastore {
+	case "flatfs":
+		d, err := flatfs.CreateOrOpen(repo, flatfs.IPFS_DEF_SHARD, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		// flatfs only takes single component keys, like an ipfs repo's
+		// blocks directory
+		return blockstore.NewBlockstoreNoPrefix(d), d, nil
+	case "badger":
+		d, err := badger.NewDatastore(repo, &badger.DefaultOptions)
+		if err != nil {
+			return nil, nil, err
+		}
+		return blockstore.NewBlockstore(d), d, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown datastore %q", datastore)
+	}
+}
+
+func get(ctx context.Context, bs blockservice.BlockService, args []string) error {
+	c, err := oneCid(args)
+	if err != nil {
+		return err
+	}
+	blk, err := bs.GetBlock(ctx, c)
+	if err != nil {
+		return err
+	}
+	return withOutput(func(w io.Writer) error {
+		_, err := w.Write(blk.RawData())
+		return err
+	})
+}
+
+func has(ctx context.Context, bs blockservice.BlockService, args []string) error {
+	c, err := oneCid(args)
+	if err != nil {
+		return err
+	}
+	ok, err := bs.Has(ctx, c)
+	if err != nil {
+		return err
+	}
+	fmt.Println(ok)
+	return nil
+}
+
+func stat(ctx context.Context, bs blockservice.BlockService, args []string) error {
+	c, err := oneCid(args)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	blk, err := bs.GetBlock(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	prefix := c.Prefix()
+	fmt.Printf("cid:     %s\n", c)
+	fmt.Printf("version: %d\n", prefix.Version)
+	fmt.Printf("codec:   %#x\n", prefix.Codec)
+	fmt.Printf("size:    %d\n", len(blk.RawData()))
+	fmt.Printf("source:  %s\n", sources.source(c))
+	fmt.Printf("took:    %s\n", time.Since(start))
+	return nil
+}
+
+func exportCar(ctx context.Context, bs blockservice.BlockService, args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected at least one root cid")
+	}
+	var roots []cid.Cid
+	for _, a := range args {
+		c, err := cid.Decode(a)
+		if err != nil {
+			return err
+		}
+		roots = append(roots, c)
+	}
+
+	opts := blockservice.ExportOptions{Version: 1, MaxDepth: depth}
+	if carV2 {
+		opts.Version = 2
+	}
+	switch order {
+	case "bfs":
+		opts.Order = blockservice.BreadthFirst
+	case "dfs":
+		opts.Order = blockservice.DepthFirst
+	default:
+		return fmt.Errorf("unknown traversal order %q", order)
+	}
+
+	return withOutput(func(w io.Writer) error {
+		return blockservice.ExportCAR(ctx, bs, roots, w, opts)
+	})
+}
+
+func importCar(ctx context.Context, bs blockservice.BlockService, args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected a single car file")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	res, err := blockservice.ImportCAR(ctx, bs, f, blockservice.ImportOptions{BatchSize: batch})
+	for _, r := range res.Roots {
+		fmt.Printf("root:    %s\n", r)
+	}
+	fmt.Printf("new:     %d\n", res.New)
+	fmt.Printf("present: %d\n", res.Present)
+	return err
+}
+
+func titanProbe(ctx context.Context, _ blockservice.BlockService, args []string) error {
+	c, err := oneCid(args)
+	if err != nil {
+		return err
+	}
+
+	client, err := titan.NewClientTitan(ctx)
+	if err != nil {
+		return fmt.Errorf("%w (set -titan)", err)
+	}
+
+	d := client.Diagnose(ctx, c)
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	}
+	fmt.Print(d)
+	return nil
+}
+
+func oneCid(args []string) (cid.Cid, error) {
+	if len(args) != 1 {
+		return cid.Undef, errors.New("expected a single cid")
+	}
+	return cid.Decode(args[0])
+}
+
+func withOutput(write func(io.Writer) error) error {
+	if out == "" {
+		return write(os.Stdout)
+	}
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func loadLevels() string {
+	var names []string
+	// levels using ipfs need an exchange, see run
+	for _, l := range []blockservice.LoadLevel{
+		blockservice.LoadOfLocalTitan,
+		blockservice.LoadOfOnlyLocal,
+		blockservice.LoadOfOnlyTitan,
+	} {
+		names = append(names, l.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// sourceRecorder is a BlockServiceObserver remembering the source serving
+// each block.
+type sourceRecorder struct {
+	lk     sync.Mutex
+	served map[cid.Cid]blockservice.Source
+}
+
+func (r *sourceRecorder) OnBlockFetched(c cid.Cid, source blockservice.Source, _ time.Duration, _ int) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.served[c] = source
+}
+
+func (r *sourceRecorder) source(c cid.Cid) string {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if s, ok := r.served[c]; ok {
+		return s.String()
+	}
+	return "unknown"
+}
+
+func (*sourceRecorder) OnBlockAdded(cid.Cid, int)                         {}
+func (*sourceRecorder) OnBlockDeleted(cid.Cid)                            {}
+func (*sourceRecorder) OnFetchFailed(cid.Cid, blockservice.Source, error) {}
+func (*sourceRecorder) OnWriteFailed(cid.Cid, error)                      {}
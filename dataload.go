@@ -4,11 +4,17 @@ import (
 	"context"
 	"fmt"
 	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice/internal"
 	"github.com/ipfs/go-blockservice/titan"
 	"github.com/ipfs/go-cid"
 	blockstore "github.com/ipfs/go-ipfs-blockstore"
 	ipld "github.com/ipfs/go-ipld-format"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
 	"sync"
+	"time"
 )
 
 const LoadLevelOfSign = "loadLevelOfSign"
@@ -26,6 +32,8 @@ const (
 	LoadOfOnlyIpfs                        // ipfs
 )
 
+const numLoadLevels = int(LoadOfOnlyIpfs) + 1
+
 func (l LoadLevel) Uint8() uint8 {
 	return uint8(l)
 }
@@ -34,38 +42,445 @@ func (l LoadLevel) Int() int {
 	return int(l)
 }
 
+func (l LoadLevel) String() string {
+	switch l {
+	case LoadOfLocalTitanIpfs:
+		return "local-titan-ipfs"
+	case LoadOfLocalTitan:
+		return "local-titan"
+	case LoadOfLocalIpfs:
+		return "local-ipfs"
+	case LoadOfOnlyLocal:
+		return "local"
+	case LoadOfOnlyTitan:
+		return "titan"
+	case LoadOfOnlyIpfs:
+		return "ipfs"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLoadLevel returns the load level named s, as printed by String.
+func ParseLoadLevel(s string) (LoadLevel, error) {
+	for l := 0; l < numLoadLevels; l++ {
+		if LoadLevel(l).String() == s {
+			return LoadLevel(l), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown load level %q", s)
+}
+
+// sources returns the sources consulted by the level, in order.
+func (l LoadLevel) sources() []Source {
+	switch l {
+	case LoadOfLocalTitanIpfs:
+		return []Source{SourceLocal, SourceTitan, SourceIpfs}
+	case LoadOfLocalTitan:
+		return []Source{SourceLocal, SourceTitan}
+	case LoadOfLocalIpfs:
+		return []Source{SourceLocal, SourceIpfs}
+	case LoadOfOnlyLocal:
+		return []Source{SourceLocal}
+	case LoadOfOnlyTitan:
+		return []Source{SourceTitan}
+	case LoadOfOnlyIpfs:
+		return []Source{SourceIpfs}
+	default:
+		return nil
+	}
+}
+
+// loadLevelFromContext returns the load level requested through ctx,
+// defaulting to LoadOfLocalTitanIpfs.
+func loadLevelFromContext(ctx context.Context) (LoadLevel, error) {
+	loadLevelInf := ctx.Value(LoadLevelOfSign)
+	if loadLevelInf == nil {
+		return LoadOfLocalTitanIpfs, nil
+	}
+	loadLevel, ok := loadLevelInf.(uint8)
+	if !ok {
+		return 0, fmt.Errorf("load level type fail")
+	}
+	if int(loadLevel) >= numLoadLevels {
+		return 0, fmt.Errorf("unknown load level")
+	}
+	return LoadLevel(loadLevel), nil
+}
+
+// metricName returns the level name in a form usable as a metric scope.
+func (l LoadLevel) metricName() string {
+	return strings.ReplaceAll(l.String(), "-", "_")
+}
+
+// loader resolves blocks for a single request according to its load level.
+type loader struct {
+	bs        blockstore.Blockstore
+	fget      func() notifiableFetcher
+	metrics   Metrics
+	observers observers
+	limits    [numSources]*rateLimiter
+	queue     *fetchQueue
+	cache     *memoryCache
+	fetched   *fetchCache
+	policy    CachePolicy
+	// strictLevels fails load levels with unavailable sources.
+	strictLevels bool
+	// batchSize and batchLatency bound the batches of blocks received
+	// from the exchange written back to the blockstore.
+	batchSize    int
+	batchLatency time.Duration
+	// reorderWindow bounds the fetches GetBlocksOrdered runs ahead.
+	reorderWindow int
+	// streamConcurrency bounds the fetches run by GetBlocksStream.
+	streamConcurrency int
+	life              *lifecycle
+	level             LoadLevel
+	// release ends the request of an asynchronous call, see finish.
+	release func()
+}
+
+// finish ends the request once an asynchronous call is over.
+func (l *loader) finish() {
+	if l.release != nil {
+		l.release()
+	}
+}
+
+// getLocal gets a block from the memory cache, the local blockstore or the
+// fetch cache.
+func (l *loader) getLocal(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	ctx, span := l.startSpan(ctx, "loader.getLocal", SourceLocal, c)
+	defer span.End()
+
+	if l.cache != nil {
+		start := time.Now()
+		l.metrics.Requested(l.level, SourceMemory)
+		blk, ok := l.cache.get(c)
+		if ok {
+			l.observe(SourceMemory, c, blk, nil, start)
+			span.SetAttributes(attribute.Bool("MemoryHit", true))
+			endSpan(span, blk, nil)
+			return blk, nil
+		}
+		l.observe(SourceMemory, c, nil, ipld.ErrNotFound{Cid: c}, start)
+	}
+
+	start := time.Now()
+	l.metrics.Requested(l.level, SourceLocal)
+	blk, err := l.bs.Get(ctx, c)
+	if ipld.IsNotFound(err) && l.fetched != nil {
+		blk, err = l.fetched.get(ctx, c)
+		span.SetAttributes(attribute.Bool("FetchCacheHit", err == nil))
+	}
+	l.observe(SourceLocal, c, blk, err, start)
+	span.SetAttributes(attribute.Bool("CacheHit", err == nil))
+	endSpan(span, blk, err)
+	if err == nil {
+		l.cache.add(blk)
+	}
+	return blk, err
+}
+
+// getTitan gets a block from a titan edge node.
+func (l *loader) getTitan(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	ctx, span := l.startSpan(ctx, "loader.getTitan", SourceTitan, c)
+	defer span.End()
+
+	l.metrics.Requested(l.level, SourceTitan)
+	if err := l.acquire(ctx, SourceTitan, 1); err != nil {
+		l.observe(SourceTitan, c, nil, err, time.Now())
+		endSpan(span, nil, err)
+		return nil, err
+	}
+	ctx = l.titanContext(ctx)
+
+	start := time.Now()
+	var blk blocks.Block
+	err := l.queue.do(ctx, PriorityFromContext(ctx), func(ctx context.Context) (err error) {
+		blk, err = titan.GetBlockFromTitan(ctx, c)
+		return err
+	})
+	l.observe(SourceTitan, c, blk, err, start)
+	if err == nil {
+		l.cache.add(blk)
+		if l.fetched != nil {
+			if err := l.putFetched(ctx, blk); err != nil {
+				logger.Errorf("could not write block from titan to the fetch cache: %s", err)
+			}
+		}
+	}
+	endSpan(span, blk, err)
+	return blk, err
+}
+
+// getIpfs gets a block from the exchange.
+func (l *loader) getIpfs(ctx context.Context, f notifiableFetcher, c cid.Cid) (blocks.Block, error) {
+	ctx, span := l.startSpan(ctx, "loader.getIpfs", SourceIpfs, c)
+	defer span.End()
+
+	l.metrics.Requested(l.level, SourceIpfs)
+	if err := l.acquire(ctx, SourceIpfs, 1); err != nil {
+		l.observe(SourceIpfs, c, nil, err, time.Now())
+		endSpan(span, nil, err)
+		return nil, err
+	}
+
+	start := time.Now()
+	var blk blocks.Block
+	err := l.queue.do(ctx, PriorityFromContext(ctx), func(ctx context.Context) (err error) {
+		if pf, ok := priorityFetcher(f); ok {
+			blk, err = pf.GetBlockWithPriority(ctx, c, PriorityFromContext(ctx))
+		} else {
+			blk, err = f.GetBlock(ctx, c)
+		}
+		return err
+	})
+	if err == nil {
+		l.limits[SourceIpfs].charge(len(blk.RawData()))
+		l.cache.add(blk)
+	}
+	l.observe(SourceIpfs, c, blk, err, start)
+	endSpan(span, blk, err)
+	return blk, err
+}
+
+// getIpfsBlocks requests ks from the exchange, holding one slot of the
+// fetch queue until the exchange closes the channel. A preempted batch is
+// queued again for the blocks still missing. Blocks that did not arrive by
+// the time the exchange closes the channel are recorded as misses.
+func (l *loader) getIpfsBlocks(ctx context.Context, f notifiableFetcher, ks []cid.Cid) (<-chan blocks.Block, error) {
+	ctx, span := l.startSpan(ctx, "loader.getIpfsBlocks", SourceIpfs, cid.Undef, attribute.Int("Count", len(ks)))
+
+	for range ks {
+		l.metrics.Requested(l.level, SourceIpfs)
+	}
+	p := PriorityFromContext(ctx)
+	request := func(ks []cid.Cid) (<-chan blocks.Block, func() bool, error) {
+		fctx, done, err := l.queue.hold(ctx, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		var rblocks <-chan blocks.Block
+		if pf, ok := priorityFetcher(f); ok {
+			rblocks, err = pf.GetBlocksWithPriority(fctx, ks, p)
+		} else {
+			rblocks, err = f.GetBlocks(fctx, ks)
+		}
+		if err != nil {
+			done()
+			return nil, nil, err
+		}
+		return rblocks, done, nil
+	}
+
+	err := l.acquire(ctx, SourceIpfs, len(ks))
+	start := time.Now()
+	var rblocks <-chan blocks.Block
+	var done func() bool
+	if err == nil {
+		rblocks, done, err = request(ks)
+	}
+	if err != nil {
+		l.metrics.Failed(l.level, SourceIpfs, err)
+		for _, c := range ks {
+			l.observers.failed(c, SourceIpfs, err)
+		}
+		endSpan(span, nil, err)
+		span.End()
+		return nil, err
+	}
+
+	pending := make(map[cid.Cid]struct{}, len(ks))
+	for _, c := range ks {
+		pending[c] = struct{}{}
+	}
+
+	out := make(chan blocks.Block)
+	go func() {
+		defer close(out)
+		received, size := 0, 0
+		defer func() {
+			for c := range pending {
+				l.metrics.Miss(l.level, SourceIpfs, time.Since(start))
+				l.observers.failed(c, SourceIpfs, ipld.ErrNotFound{Cid: c})
+			}
+			span.SetAttributes(attribute.Int("Received", received), attribute.Int("Size", size))
+			span.End()
+		}()
+		for {
+			for b := range rblocks {
+				received++
+				size += len(b.RawData())
+				delete(pending, b.Cid())
+				l.limits[SourceIpfs].charge(len(b.RawData()))
+				l.cache.add(b)
+				l.metrics.Hit(l.level, SourceIpfs, len(b.RawData()), time.Since(start))
+				l.observers.fetched(b.Cid(), SourceIpfs, time.Since(start), len(b.RawData()))
+				select {
+				case out <- b:
+				case <-ctx.Done():
+					done()
+					return
+				}
+			}
+			if !done() || len(pending) == 0 {
+				return
+			}
+			logger.Debugf("background batch preempted, queueing %d blocks again", len(pending))
+			missing := make([]cid.Cid, 0, len(pending))
+			for _, c := range ks {
+				if _, ok := pending[c]; ok {
+					missing = append(missing, c)
+				}
+			}
+			var err error
+			if rblocks, done, err = request(missing); err != nil {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// putFetched writes remotely fetched blocks to the fetch cache when there is
+// one, to the blockstore otherwise.
+func (l *loader) putFetched(ctx context.Context, blks ...blocks.Block) error {
+	size := 0
+	for _, b := range blks {
+		size += len(b.RawData())
+	}
+	ctx, span := internal.StartSpan(ctx, "loader.putFetched", trace.WithAttributes(
+		attribute.Stringer("LoadLevel", l.level),
+		attribute.Int("Count", len(blks)),
+		attribute.Int("Size", size),
+	))
+	defer span.End()
+
+	var err error
+	switch {
+	case l.fetched != nil:
+		err = l.fetched.put(ctx, blks...)
+	case len(blks) == 1:
+		err = l.bs.Put(ctx, blks[0])
+	default:
+		err = l.bs.PutMany(ctx, blks)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		l.metrics.WriteFailed(l.level, len(blks), err)
+		for _, b := range blks {
+			l.observers.writeFailed(b.Cid(), err)
+		}
+		return err
+	}
+	l.metrics.Written(l.level, len(blks), size)
+	return nil
+}
+
+// titanContext returns ctx throttling the data read from edge nodes by the
+// titan byte limit, if any.
+func (l *loader) titanContext(ctx context.Context) context.Context {
+	if lim := l.limits[SourceTitan]; lim != nil && lim.bytes != nil {
+		return titan.WithReadLimiter(ctx, lim)
+	}
+	return ctx
+}
+
+// acquire takes n requests from the rate limit of source, if any.
+func (l *loader) acquire(ctx context.Context, source Source, n int) error {
+	lim := l.limits[source]
+	if lim == nil {
+		return nil
+	}
+	start := time.Now()
+	err := lim.acquire(ctx, n)
+	if waited := time.Since(start); waited > time.Millisecond {
+		trace.SpanFromContext(ctx).AddEvent("rate limited", trace.WithAttributes(
+			attribute.Stringer("Source", source),
+			attribute.Int64("WaitMillis", waited.Milliseconds()),
+		))
+	}
+	return err
+}
+
+func (l *loader) observe(source Source, c cid.Cid, blk blocks.Block, err error, start time.Time) {
+	switch {
+	case err == nil:
+		l.metrics.Hit(l.level, source, len(blk.RawData()), time.Since(start))
+		l.observers.fetched(c, source, time.Since(start), len(blk.RawData()))
+		return
+	case ipld.IsNotFound(err):
+		l.metrics.Miss(l.level, source, time.Since(start))
+	default:
+		l.metrics.Failed(l.level, source, err)
+	}
+	if source != SourceLocal && source != SourceMemory {
+		l.observers.failed(c, source, err)
+	}
+}
+
+// fallback marks the point where a request moves on to the next source.
+func (l *loader) fallback(ctx context.Context, from, to Source) {
+	trace.SpanFromContext(ctx).AddEvent("fallback", trace.WithAttributes(
+		attribute.Stringer("From", from),
+		attribute.Stringer("To", to),
+	))
+}
+
+func (l *loader) startSpan(ctx context.Context, name string, source Source, c cid.Cid, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs,
+		attribute.Stringer("Source", source),
+		attribute.Stringer("LoadLevel", l.level),
+		attribute.Stringer("Priority", PriorityFromContext(ctx)),
+	)
+	if c.Defined() {
+		attrs = append(attrs, attribute.Stringer("CID", c))
+	}
+	return internal.StartSpan(ctx, name, trace.WithAttributes(attrs...))
+}
+
+func endSpan(span trace.Span, blk blocks.Block, err error) {
+	if err != nil {
+		if !ipld.IsNotFound(err) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return
+	}
+	span.SetAttributes(attribute.Int("Size", len(blk.RawData())))
+}
+
 // local > titan > ipfs to load block data
-func loadBlockByLocalTitanIpfs(ctx context.Context, c cid.Cid, bs blockstore.Blockstore, fget func() notifiableFetcher) (blocks.Block, error) {
-	block, err := bs.Get(ctx, c)
+func (l *loader) loadBlockByLocalTitanIpfs(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	block, err := l.getLocal(ctx, c)
 	if err == nil {
 		logger.Debugf("got block success from local By cid : %s", c)
 		return block, nil
 	}
 
-	titanBlock, terr := titan.GetBlockFromTitan(ctx, c)
+	l.fallback(ctx, SourceLocal, SourceTitan)
+	titanBlock, terr := l.getTitan(ctx, c)
 	if terr == nil {
 		logger.Debugf("got block success from titan By cid : %s", c.String())
 		return titanBlock, nil
 	}
 
-	if ipld.IsNotFound(err) && fget != nil {
-		f := fget() // Don't load the exchange until we have to
+	if ipld.IsNotFound(err) && l.fget != nil {
+		l.fallback(ctx, SourceTitan, SourceIpfs)
+		f := l.fget() // Don't load the exchange until we have to
 
 		// TODO be careful checking ErrNotFound. If the underlying
 		// implementation changes, this will break.
 		logger.Debug("Block service: Searching bitswap")
-		blk, err := f.GetBlock(ctx, c)
+		blk, err := l.getIpfs(ctx, f, c)
 		if err != nil {
 			return nil, err
 		}
 		logger.Debugf("got block success from ipfs network By cid : %s", c)
 		// also write in the block store for caching, inform the exchange that the block is available
-		err = bs.Put(ctx, blk)
-		if err != nil {
-			return nil, err
-		}
-		err = f.NotifyNewBlocks(ctx, blk)
-		if err != nil {
+		if err := l.writeFetched(ctx, f, blk); err != nil {
 			return nil, err
 		}
 		logger.Debugf("BlockService.BlockFetched %s", c)
@@ -76,10 +491,10 @@ func loadBlockByLocalTitanIpfs(ctx context.Context, c cid.Cid, bs blockstore.Blo
 	return nil, err
 }
 
-func loadBlocksByLocalTitanIpfs(ctx context.Context, ks []cid.Cid, bs blockstore.Blockstore, fget func() notifiableFetcher, out chan blocks.Block) {
+func (l *loader) loadBlocksByLocalTitanIpfs(ctx context.Context, ks []cid.Cid, out chan blocks.Block) {
 	var misses []cid.Cid
 	for _, c := range ks {
-		hit, err := bs.Get(ctx, c)
+		hit, err := l.getLocal(ctx, c)
 		if err != nil {
 			misses = append(misses, c)
 			continue
@@ -93,16 +508,20 @@ func loadBlocksByLocalTitanIpfs(ctx context.Context, ks []cid.Cid, bs blockstore
 	}
 
 	var wg sync.WaitGroup
+	var lk sync.Mutex
 	var titanMisses []cid.Cid
 	if len(misses) != 0 {
+		l.fallback(ctx, SourceLocal, SourceTitan)
 		wg.Add(len(misses))
 		for _, c := range misses {
 			value := c
 			go func(cid cid.Cid) {
 				defer wg.Done()
-				hit, err := titan.GetBlockFromTitan(ctx, cid)
+				hit, err := l.getTitan(ctx, cid)
 				if err != nil {
+					lk.Lock()
 					titanMisses = append(titanMisses, cid)
+					lk.Unlock()
 					return
 				}
 				select {
@@ -116,77 +535,32 @@ func loadBlocksByLocalTitanIpfs(ctx context.Context, ks []cid.Cid, bs blockstore
 	}
 	wg.Wait()
 
-	if len(titanMisses) == 0 || fget == nil {
+	if len(titanMisses) == 0 || l.fget == nil {
 		return
 	}
 
-	f := fget() // don't load exchange unless we have to
-	rblocks, err := f.GetBlocks(ctx, titanMisses)
+	l.fallback(ctx, SourceTitan, SourceIpfs)
+	f := l.fget() // don't load exchange unless we have to
+	rblocks, err := l.getIpfsBlocks(ctx, f, titanMisses)
 	if err != nil {
 		logger.Debugf("Error with GetBlocks: %s", err)
 		return
 	}
 
-	// batch available blocks together
-	const batchSize = 32
-	batch := make([]blocks.Block, 0, batchSize)
-	for {
-		var noMoreBlocks bool
-	batchLoop:
-		for len(batch) < batchSize {
-			select {
-			case b, ok := <-rblocks:
-				if !ok {
-					noMoreBlocks = true
-					break batchLoop
-				}
-				logger.Debugf("got block success from ipfs network By cid : %s", b.Cid())
-				// logger.Debugf("BlockService.BlockFetched %s", b.Cid())
-				batch = append(batch, b)
-			case <-ctx.Done():
-				return
-			default:
-				break batchLoop
-			}
-		}
-
-		// also write in the blockstore for caching, inform the exchange that the blocks are available
-		err = bs.PutMany(ctx, batch)
-		if err != nil {
-			logger.Errorf("could not write blocks from the network to the blockstore: %s", err)
-			return
-		}
-
-		err = f.NotifyNewBlocks(ctx, batch...)
-		if err != nil {
-			logger.Errorf("could not tell the exchange about new blocks: %s", err)
-			return
-		}
-
-		for _, b := range batch {
-			select {
-			case out <- b:
-			case <-ctx.Done():
-				return
-			}
-		}
-		batch = batch[:0]
-		if noMoreBlocks {
-			break
-		}
-	}
+	l.forwardFetched(ctx, f, rblocks, out)
 }
 
 // local > titan to load block data
-func loadBlockByLocalTitan(ctx context.Context, c cid.Cid, bs blockstore.Blockstore) (blocks.Block, error) {
-	block, err := bs.Get(ctx, c)
+func (l *loader) loadBlockByLocalTitan(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	block, err := l.getLocal(ctx, c)
 	if err == nil {
 		logger.Debugf("got block success from local By cid : %s", c)
 		return block, nil
 	}
 
 	if ipld.IsNotFound(err) {
-		titanBlock, err := titan.GetBlockFromTitan(ctx, c)
+		l.fallback(ctx, SourceLocal, SourceTitan)
+		titanBlock, err := l.getTitan(ctx, c)
 		if err == nil {
 			logger.Debugf("got block success from titan By cid : %s", c.String())
 			return titanBlock, nil
@@ -197,10 +571,10 @@ func loadBlockByLocalTitan(ctx context.Context, c cid.Cid, bs blockstore.Blockst
 	return nil, err
 }
 
-func loadBlocksByLocalTitan(ctx context.Context, ks []cid.Cid, bs blockstore.Blockstore, out chan blocks.Block) {
+func (l *loader) loadBlocksByLocalTitan(ctx context.Context, ks []cid.Cid, out chan blocks.Block) {
 	var misses []cid.Cid
 	for _, c := range ks {
-		hit, err := bs.Get(ctx, c)
+		hit, err := l.getLocal(ctx, c)
 		if err != nil {
 			misses = append(misses, c)
 			continue
@@ -214,16 +588,20 @@ func loadBlocksByLocalTitan(ctx context.Context, ks []cid.Cid, bs blockstore.Blo
 	}
 
 	var wg sync.WaitGroup
+	var lk sync.Mutex
 	var titanMisses []cid.Cid
 	if len(misses) != 0 {
+		l.fallback(ctx, SourceLocal, SourceTitan)
 		wg.Add(len(misses))
 		for _, c := range misses {
 			value := c
 			go func(cid cid.Cid) {
 				defer wg.Done()
-				hit, err := titan.GetBlockFromTitan(ctx, cid)
+				hit, err := l.getTitan(ctx, cid)
 				if err != nil {
+					lk.Lock()
 					titanMisses = append(titanMisses, cid)
+					lk.Unlock()
 					return
 				}
 				select {
@@ -239,31 +617,27 @@ func loadBlocksByLocalTitan(ctx context.Context, ks []cid.Cid, bs blockstore.Blo
 }
 
 // local > ipfs to load block data
-func loadBlockByLocalIpfs(ctx context.Context, c cid.Cid, bs blockstore.Blockstore, fget func() notifiableFetcher) (blocks.Block, error) {
-	block, err := bs.Get(ctx, c)
+func (l *loader) loadBlockByLocalIpfs(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	block, err := l.getLocal(ctx, c)
 	if err == nil {
 		logger.Debugf("got block success from local By cid : %s", c)
 		return block, nil
 	}
 
-	if ipld.IsNotFound(err) && fget != nil {
-		f := fget() // Don't load the exchange until we have to
+	if ipld.IsNotFound(err) && l.fget != nil {
+		l.fallback(ctx, SourceLocal, SourceIpfs)
+		f := l.fget() // Don't load the exchange until we have to
 
 		// TODO be careful checking ErrNotFound. If the underlying
 		// implementation changes, this will break.
 		logger.Debug("Block service: Searching bitswap")
-		blk, err := f.GetBlock(ctx, c)
+		blk, err := l.getIpfs(ctx, f, c)
 		if err != nil {
 			return nil, err
 		}
 		logger.Debugf("got block success from ipfs network By cid : %s", c)
 		// also write in the block store for caching, inform the exchange that the block is available
-		err = bs.Put(ctx, blk)
-		if err != nil {
-			return nil, err
-		}
-		err = f.NotifyNewBlocks(ctx, blk)
-		if err != nil {
+		if err := l.writeFetched(ctx, f, blk); err != nil {
 			return nil, err
 		}
 		logger.Debugf("BlockService.BlockFetched %s", c)
@@ -273,10 +647,10 @@ func loadBlockByLocalIpfs(ctx context.Context, c cid.Cid, bs blockstore.Blocksto
 	logger.Debug("Block service GetBlock: Not found")
 	return nil, err
 }
-func loadBlocksByLocalIpfs(ctx context.Context, ks []cid.Cid, bs blockstore.Blockstore, fget func() notifiableFetcher, out chan blocks.Block) {
+func (l *loader) loadBlocksByLocalIpfs(ctx context.Context, ks []cid.Cid, out chan blocks.Block) {
 	var misses []cid.Cid
 	for _, c := range ks {
-		hit, err := bs.Get(ctx, c)
+		hit, err := l.getLocal(ctx, c)
 		if err != nil {
 			misses = append(misses, c)
 			continue
@@ -289,70 +663,24 @@ func loadBlocksByLocalIpfs(ctx context.Context, ks []cid.Cid, bs blockstore.Bloc
 		}
 	}
 
-	if len(misses) == 0 || fget == nil {
+	if len(misses) == 0 || l.fget == nil {
 		return
 	}
 
-	f := fget() // don't load exchange unless we have to
-	rblocks, err := f.GetBlocks(ctx, misses)
+	l.fallback(ctx, SourceLocal, SourceIpfs)
+	f := l.fget() // don't load exchange unless we have to
+	rblocks, err := l.getIpfsBlocks(ctx, f, misses)
 	if err != nil {
 		logger.Debugf("Error with GetBlocks: %s", err)
 		return
 	}
 
-	// batch available blocks together
-	const batchSize = 32
-	batch := make([]blocks.Block, 0, batchSize)
-	for {
-		var noMoreBlocks bool
-	batchLoop:
-		for len(batch) < batchSize {
-			select {
-			case b, ok := <-rblocks:
-				if !ok {
-					noMoreBlocks = true
-					break batchLoop
-				}
-				logger.Debugf("got block success from ipfs network By cid : %s", b.Cid())
-				// logger.Debugf("BlockService.BlockFetched %s", b.Cid())
-				batch = append(batch, b)
-			case <-ctx.Done():
-				return
-			default:
-				break batchLoop
-			}
-		}
-
-		// also write in the blockstore for caching, inform the exchange that the blocks are available
-		err = bs.PutMany(ctx, batch)
-		if err != nil {
-			logger.Errorf("could not write blocks from the network to the blockstore: %s", err)
-			return
-		}
-
-		err = f.NotifyNewBlocks(ctx, batch...)
-		if err != nil {
-			logger.Errorf("could not tell the exchange about new blocks: %s", err)
-			return
-		}
-
-		for _, b := range batch {
-			select {
-			case out <- b:
-			case <-ctx.Done():
-				return
-			}
-		}
-		batch = batch[:0]
-		if noMoreBlocks {
-			break
-		}
-	}
+	l.forwardFetched(ctx, f, rblocks, out)
 }
 
 // local to load block data
-func loadBlockByLocal(ctx context.Context, c cid.Cid, bs blockstore.Blockstore) (blocks.Block, error) {
-	block, err := bs.Get(ctx, c)
+func (l *loader) loadBlockByLocal(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	block, err := l.getLocal(ctx, c)
 	if err == nil {
 		logger.Debugf("got block success from local By cid : %s", c)
 		return block, nil
@@ -362,9 +690,9 @@ func loadBlockByLocal(ctx context.Context, c cid.Cid, bs blockstore.Blockstore)
 	return nil, err
 }
 
-func loadBlocksByLocal(ctx context.Context, ks []cid.Cid, bs blockstore.Blockstore, out chan blocks.Block) {
+func (l *loader) loadBlocksByLocal(ctx context.Context, ks []cid.Cid, out chan blocks.Block) {
 	for _, c := range ks {
-		hit, err := bs.Get(ctx, c)
+		hit, err := l.getLocal(ctx, c)
 		if err != nil {
 			continue
 		}
@@ -378,8 +706,8 @@ func loadBlocksByLocal(ctx context.Context, ks []cid.Cid, bs blockstore.Blocksto
 }
 
 // titan to load block data
-func loadBlockByTitan(ctx context.Context, c cid.Cid) (blocks.Block, error) {
-	titanBlock, terr := titan.GetBlockFromTitan(ctx, c)
+func (l *loader) loadBlockByTitan(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	titanBlock, terr := l.getTitan(ctx, c)
 	if terr == nil {
 		logger.Debugf("got block success from titan By cid : %s", c.String())
 		return titanBlock, nil
@@ -389,7 +717,7 @@ func loadBlockByTitan(ctx context.Context, c cid.Cid) (blocks.Block, error) {
 	return nil, terr
 }
 
-func loadBlocksByTitan(ctx context.Context, ks []cid.Cid, out chan blocks.Block) {
+func (l *loader) loadBlocksByTitan(ctx context.Context, ks []cid.Cid, out chan blocks.Block) {
 	var wg sync.WaitGroup
 	if len(ks) != 0 {
 		wg.Add(len(ks))
@@ -397,7 +725,7 @@ func loadBlocksByTitan(ctx context.Context, ks []cid.Cid, out chan blocks.Block)
 			value := c
 			go func(cid cid.Cid) {
 				defer wg.Done()
-				hit, err := titan.GetBlockFromTitan(ctx, cid)
+				hit, err := l.getTitan(ctx, cid)
 				if err != nil {
 					logger.Errorf("get block fail from titan By cid : %s, error : %s", cid, err.Error())
 					return
@@ -415,92 +743,40 @@ func loadBlocksByTitan(ctx context.Context, ks []cid.Cid, out chan blocks.Block)
 }
 
 // ipfs to load block data
-func loadBlockByIpfs(ctx context.Context, c cid.Cid, bs blockstore.Blockstore, fget func() notifiableFetcher) (blocks.Block, error) {
-	if fget != nil {
-		f := fget() // Don't load the exchange until we have to
+func (l *loader) loadBlockByIpfs(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if l.fget != nil {
+		f := l.fget() // Don't load the exchange until we have to
 
 		// TODO be careful checking ErrNotFound. If the underlying
 		// implementation changes, this will break.
 		logger.Debug("Block service: Searching bitswap")
-		blk, err := f.GetBlock(ctx, c)
+		blk, err := l.getIpfs(ctx, f, c)
 		if err != nil {
 			return nil, err
 		}
 		logger.Debugf("got block success from ipfs network By cid : %s", c)
 		// also write in the block store for caching, inform the exchange that the block is available
-		err = bs.Put(ctx, blk)
-		if err != nil {
-			return nil, err
-		}
-		err = f.NotifyNewBlocks(ctx, blk)
-		if err != nil {
+		if err := l.writeFetched(ctx, f, blk); err != nil {
 			return nil, err
 		}
 		logger.Debugf("BlockService.BlockFetched %s", c)
 		return blk, nil
 	}
 	logger.Debug("Block service GetBlock: Not found")
-	return nil, fmt.Errorf("notifiable fetcher is null")
+	return nil, &OfflineError{Level: l.level, Unavailable: []Source{SourceIpfs}}
 }
 
-func loadBlocksByIpfs(ctx context.Context, ks []cid.Cid, bs blockstore.Blockstore, fget func() notifiableFetcher, out chan blocks.Block) {
-	if len(ks) == 0 || fget == nil {
+func (l *loader) loadBlocksByIpfs(ctx context.Context, ks []cid.Cid, out chan blocks.Block) {
+	if len(ks) == 0 || l.fget == nil {
 		return
 	}
 
-	f := fget() // don't load exchange unless we have to
-	rblocks, err := f.GetBlocks(ctx, ks)
+	f := l.fget() // don't load exchange unless we have to
+	rblocks, err := l.getIpfsBlocks(ctx, f, ks)
 	if err != nil {
 		logger.Debugf("Error with GetBlocks: %s", err)
 		return
 	}
 
-	// batch available blocks together
-	const batchSize = 32
-	batch := make([]blocks.Block, 0, batchSize)
-	for {
-		var noMoreBlocks bool
-	batchLoop:
-		for len(batch) < batchSize {
-			select {
-			case b, ok := <-rblocks:
-				if !ok {
-					noMoreBlocks = true
-					break batchLoop
-				}
-				logger.Debugf("got block success from ipfs network By cid : %s", b.Cid())
-				// logger.Debugf("BlockService.BlockFetched %s", b.Cid())
-				batch = append(batch, b)
-			case <-ctx.Done():
-				return
-			default:
-				break batchLoop
-			}
-		}
-
-		// also write in the blockstore for caching, inform the exchange that the blocks are available
-		err = bs.PutMany(ctx, batch)
-		if err != nil {
-			logger.Errorf("could not write blocks from the network to the blockstore: %s", err)
-			return
-		}
-
-		err = f.NotifyNewBlocks(ctx, batch...)
-		if err != nil {
-			logger.Errorf("could not tell the exchange about new blocks: %s", err)
-			return
-		}
-
-		for _, b := range batch {
-			select {
-			case out <- b:
-			case <-ctx.Done():
-				return
-			}
-		}
-		batch = batch[:0]
-		if noMoreBlocks {
-			break
-		}
-	}
+	l.forwardFetched(ctx, f, rblocks, out)
 }
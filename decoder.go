@@ -0,0 +1,188 @@
+package blockservice
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// defaultDecoder is used to discover links when no decoder is configured.
+// ipld.DefaultBlockDecoder only knows the codecs registered by packages such
+// as go-merkledag, so dag-pb and raw blocks are decoded here and the other
+// codecs are left to it.
+var defaultDecoder ipld.BlockDecoder = builtinDecoder{}
+
+type builtinDecoder struct{}
+
+// Register registers decoders for the codecs not decoded by blockservice.
+func (builtinDecoder) Register(codec uint64, decoder ipld.DecodeBlockFunc) {
+	ipld.DefaultBlockDecoder.Register(codec, decoder)
+}
+
+func (builtinDecoder) Decode(b blocks.Block) (ipld.Node, error) {
+	switch b.Cid().Prefix().Codec {
+	case cid.Raw:
+		return &decodedNode{Block: b}, nil
+	case cid.DagProtobuf:
+		ls, err := dagpbLinks(b.RawData())
+		if err != nil {
+			return nil, fmt.Errorf("decoding dag-pb block %s: %w", b.Cid(), err)
+		}
+		return &decodedNode{Block: b, links: ls}, nil
+	default:
+		return ipld.DefaultBlockDecoder.Decode(b)
+	}
+}
+
+var errNoLink = errors.New("no such link")
+
+// decodedNode is a decoded block exposing only its links.
+type decodedNode struct {
+	blocks.Block
+	links []*ipld.Link
+}
+
+func (n *decodedNode) Resolve(path []string) (interface{}, []string, error) {
+	return n.ResolveLink(path)
+}
+
+func (n *decodedNode) Tree(path string, depth int) []string {
+	if path != "" || depth == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(n.links))
+	for _, l := range n.links {
+		names = append(names, l.Name)
+	}
+	return names
+}
+
+func (n *decodedNode) ResolveLink(path []string) (*ipld.Link, []string, error) {
+	if len(path) == 0 {
+		return nil, nil, errNoLink
+	}
+	for _, l := range n.links {
+		if l.Name == path[0] {
+			return l, path[1:], nil
+		}
+	}
+	return nil, nil, errNoLink
+}
+
+func (n *decodedNode) Copy() ipld.Node {
+	ls := make([]*ipld.Link, len(n.links))
+	for i, l := range n.links {
+		cp := *l
+		ls[i] = &cp
+	}
+	return &decodedNode{Block: n.Block, links: ls}
+}
+
+func (n *decodedNode) Links() []*ipld.Link {
+	return n.links
+}
+
+func (n *decodedNode) Stat() (*ipld.NodeStat, error) {
+	size, err := n.Size()
+	if err != nil {
+		return nil, err
+	}
+	return &ipld.NodeStat{
+		Hash:           n.Cid().String(),
+		NumLinks:       len(n.links),
+		BlockSize:      len(n.RawData()),
+		CumulativeSize: int(size),
+	}, nil
+}
+
+func (n *decodedNode) Size() (uint64, error) {
+	size := uint64(len(n.RawData()))
+	for _, l := range n.links {
+		size += l.Size
+	}
+	return size, nil
+}
+
+// dagpbLinks returns the links of a dag-pb encoded PBNode.
+func dagpbLinks(data []byte) ([]*ipld.Link, error) {
+	var ls []*ipld.Link
+	err := protoFields(data, func(num int, _ uint64, b []byte) error {
+		if num != 2 { // PBNode.Links
+			return nil
+		}
+		l := &ipld.Link{}
+		err := protoFields(b, func(num int, v uint64, b []byte) error {
+			switch num {
+			case 1: // PBLink.Hash
+				c, err := cid.Cast(b)
+				if err != nil {
+					return err
+				}
+				l.Cid = c
+			case 2: // PBLink.Name
+				l.Name = string(b)
+			case 3: // PBLink.Tsize
+				l.Size = v
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !l.Cid.Defined() {
+			return errors.New("link without hash")
+		}
+		ls = append(ls, l)
+		return nil
+	})
+	return ls, err
+}
+
+// protoFields calls fn with every field of a protobuf message: varint
+// values are passed in v, length-delimited ones in b.
+func protoFields(msg []byte, fn func(num int, v uint64, b []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errors.New("invalid protobuf field key")
+		}
+		msg = msg[n:]
+
+		var v uint64
+		var b []byte
+		switch key & 7 {
+		case 0: // varint
+			v, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			msg = msg[n:]
+		case 1: // 64-bit
+			if len(msg) < 8 {
+				return errors.New("truncated protobuf message")
+			}
+			msg = msg[8:]
+		case 2: // length-delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return errors.New("truncated protobuf message")
+			}
+			b, msg = msg[n:n+int(l)], msg[n+int(l):]
+		case 5: // 32-bit
+			if len(msg) < 4 {
+				return errors.New("truncated protobuf message")
+			}
+			msg = msg[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		if err := fn(int(key>>3), v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package blockservice
+
+import (
+	"context"
+
+	cid "github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ipfs/go-blockservice/internal"
+	"github.com/ipfs/go-blockservice/titan"
+)
+
+// BatchDeleter can be implemented by blockstores able to delete several
+// blocks in a single batch.
+type BatchDeleter interface {
+	DeleteMany(ctx context.Context, ks []cid.Cid) error
+}
+
+// RemovalNotifier can be implemented by exchanges that should be told when
+// blocks are no longer served.
+type RemovalNotifier interface {
+	NotifyRemovedBlocks(ctx context.Context, ks ...cid.Cid) error
+}
+
+// BlocksDeleter is implemented by the BlockServices returned by New, to
+// delete several blocks at once. Callers type-assert to use it.
+type BlocksDeleter interface {
+	// DeleteBlocks deletes the given blocks using batching capabilities
+	// of the underlying blockstore whenever possible, returning one result
+	// per CID.
+	DeleteBlocks(ctx context.Context, ks []cid.Cid, opts ...DeleteOption) []DeleteResult
+}
+
+var _ BlocksDeleter = (*blockService)(nil)
+
+// DeleteResult is the outcome of deleting a single block.
+type DeleteResult struct {
+	Cid cid.Cid
+	Err error
+}
+
+// DeleteOption configures DeleteBlocks.
+type DeleteOption func(*deleteOptions)
+
+type deleteOptions struct {
+	notifyExchange bool
+	titanDeviceID  string
+}
+
+// NotifyExchange tells the exchange about deleted blocks if it implements
+// RemovalNotifier.
+func NotifyExchange() DeleteOption {
+	return func(o *deleteOptions) {
+		o.notifyExchange = true
+	}
+}
+
+// NotifyTitan tells the titan schedulers found in the request context that
+// the node identified by deviceID no longer caches the deleted blocks.
+func NotifyTitan(deviceID string) DeleteOption {
+	return func(o *deleteOptions) {
+		o.titanDeviceID = deviceID
+	}
+}
+
+// DeleteBlocks deletes the given blocks from the blockstore, in a single
+// batch if the blockstore implements BatchDeleter, and returns one result
+// per CID in the order given. Failures to notify the exchange or titan are
+// logged and don't affect the results.
+func (s *blockService) DeleteBlocks(ctx context.Context, ks []cid.Cid, opts ...DeleteOption) []DeleteResult {
+	ctx, span := internal.StartSpan(ctx, "blockService.DeleteBlocks", trace.WithAttributes(attribute.Int("Count", len(ks))))
+	defer span.End()
+
+	ctx, done := s.life.begin(ctx)
+	if done == nil {
+		results := make([]DeleteResult, len(ks))
+		for i, c := range ks {
+			results[i] = DeleteResult{Cid: c, Err: ErrClosed}
+		}
+		return results
+	}
+	defer done()
+
+	var o deleteOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	results := make([]DeleteResult, len(ks))
+	for i, c := range ks {
+		results[i].Cid = c
+	}
+
+	if bd, ok := s.blockstore.(BatchDeleter); ok && len(ks) > 1 {
+		if err := bd.DeleteMany(ctx, ks); err != nil {
+			for i := range results {
+				results[i].Err = err
+			}
+		}
+	} else {
+		for i, c := range ks {
+			results[i].Err = s.blockstore.DeleteBlock(ctx, c)
+		}
+	}
+
+	s.cache.remove(ks...)
+	if s.fetched != nil {
+		s.fetched.remove(ctx, ks...)
+	}
+
+	deleted := make([]cid.Cid, 0, len(ks))
+	for _, r := range results {
+		if r.Err == nil {
+			logger.Debugf("BlockService.BlockDeleted %s", r.Cid)
+			s.observers.deleted(r.Cid)
+			deleted = append(deleted, r.Cid)
+		}
+	}
+	if len(deleted) == 0 {
+		return results
+	}
+
+	if o.notifyExchange {
+		if rn, ok := s.currentExchange().(RemovalNotifier); ok {
+			if err := rn.NotifyRemovedBlocks(ctx, deleted...); err != nil {
+				logger.Errorf("NotifyRemovedBlocks: %s", err.Error())
+			}
+		}
+	}
+	if o.titanDeviceID != "" {
+		if err := titan.DeleteBlocksFromTitan(ctx, o.titanDeviceID, deleted); err != nil {
+			logger.Errorf("DeleteBlocksFromTitan: %s", err.Error())
+		}
+	}
+	return results
+}
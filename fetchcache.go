@@ -0,0 +1,263 @@
+package blockservice
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// FetchCacheOptions bounds the blockstore receiving remotely fetched blocks.
+type FetchCacheOptions struct {
+	// MaxBytes is the size budget of the cache, 0 for unbounded. The least
+	// recently used blocks are deleted once it is exceeded.
+	MaxBytes int64
+	// TTL is how long a fetched block is kept, 0 to keep blocks until they
+	// are evicted by size. Expired blocks are deleted when next read.
+	TTL time.Duration
+}
+
+// WithFetchCache writes blocks fetched from titan or the exchange to bs
+// instead of the primary blockstore. AddBlock(s) still write to the primary
+// blockstore, reads consult the primary blockstore first and then bs.
+// Blocks only held by the fetch cache are not announced to the exchange,
+// which serves peers from the primary blockstore.
+//
+// The blocks already in bs are indexed in the background; until the index
+// is complete they are looked up in bs directly, and neither expire nor
+// count towards MaxBytes. bs should not be written to by anything else.
+func WithFetchCache(bs blockstore.Blockstore, opts FetchCacheOptions) Option {
+	return func(s *blockService) {
+		if s.fetched != nil {
+			s.fetched.close()
+		}
+		if bs == nil {
+			s.fetched = nil
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		s.fetched = &fetchCache{
+			bs:     bs,
+			max:    opts.MaxBytes,
+			ttl:    opts.TTL,
+			ready:  make(chan struct{}),
+			cancel: cancel,
+			ll:     list.New(),
+			items:  make(map[string]*list.Element),
+		}
+		go s.fetched.load(ctx)
+	}
+}
+
+// fetchCache indexes the blocks of a cache blockstore by recency of use.
+type fetchCache struct {
+	bs  blockstore.Blockstore
+	max int64
+	ttl time.Duration
+
+	// ready is closed once the blocks found in bs are indexed.
+	ready  chan struct{}
+	cancel context.CancelFunc
+
+	lk    sync.Mutex
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element // keyed by multihash like the blockstore
+}
+
+type fetchEntry struct {
+	c     cid.Cid
+	size  int
+	added time.Time
+}
+
+// load indexes the blocks already in the cache blockstore.
+func (f *fetchCache) load(ctx context.Context) {
+	keys, err := f.bs.AllKeysChan(ctx)
+	if err != nil {
+		logger.Errorf("could not index the fetch cache: %s", err)
+		return
+	}
+	now := time.Now()
+	for c := range keys {
+		size, err := f.bs.GetSize(ctx, c)
+		if err != nil {
+			continue
+		}
+		f.lk.Lock()
+		// blocks put meanwhile are already indexed
+		if _, ok := f.items[string(c.Hash())]; !ok {
+			f.insert(fetchEntry{c: c, size: size, added: now})
+		}
+		f.lk.Unlock()
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	close(f.ready)
+	f.evict(ctx)
+}
+
+// indexed reports whether load has completed.
+func (f *fetchCache) indexed() bool {
+	select {
+	case <-f.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops indexing the cache blockstore.
+func (f *fetchCache) close() {
+	f.cancel()
+}
+
+// lookup returns the entry of c, dropping it when expired. Until the index
+// is complete, blocks missing from it are looked up in the cache
+// blockstore.
+func (f *fetchCache) lookup(ctx context.Context, c cid.Cid) (fetchEntry, bool) {
+	f.lk.Lock()
+	e, ok := f.items[string(c.Hash())]
+	if !ok {
+		f.lk.Unlock()
+		if f.indexed() {
+			return fetchEntry{}, false
+		}
+		size, err := f.bs.GetSize(ctx, c)
+		if err != nil {
+			return fetchEntry{}, false
+		}
+		return fetchEntry{c: c, size: size}, true
+	}
+	entry := e.Value.(fetchEntry)
+	if f.ttl > 0 && time.Since(entry.added) > f.ttl {
+		f.removeElement(e)
+		f.lk.Unlock()
+		if err := f.bs.DeleteBlock(ctx, c); err != nil {
+			logger.Debugf("could not delete expired block %s: %s", c, err)
+		}
+		return fetchEntry{}, false
+	}
+	f.ll.MoveToFront(e)
+	f.lk.Unlock()
+	return entry, true
+}
+
+func (f *fetchCache) get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	if _, ok := f.lookup(ctx, c); !ok {
+		return nil, ipld.ErrNotFound{Cid: c}
+	}
+	return f.bs.Get(ctx, c)
+}
+
+func (f *fetchCache) has(ctx context.Context, c cid.Cid) bool {
+	_, ok := f.lookup(ctx, c)
+	return ok
+}
+
+func (f *fetchCache) getSize(ctx context.Context, c cid.Cid) (int, error) {
+	entry, ok := f.lookup(ctx, c)
+	if !ok {
+		return -1, ipld.ErrNotFound{Cid: c}
+	}
+	return entry.size, nil
+}
+
+// put writes blks to the cache blockstore and evicts blocks over budget.
+func (f *fetchCache) put(ctx context.Context, blks ...blocks.Block) error {
+	var err error
+	if len(blks) == 1 {
+		err = f.bs.Put(ctx, blks[0])
+	} else {
+		err = f.bs.PutMany(ctx, blks)
+	}
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	f.lk.Lock()
+	for _, b := range blks {
+		f.insert(fetchEntry{c: b.Cid(), size: len(b.RawData()), added: now})
+	}
+	f.lk.Unlock()
+	f.evict(ctx)
+	return nil
+}
+
+// remove forgets ks and deletes them from the cache blockstore.
+func (f *fetchCache) remove(ctx context.Context, ks ...cid.Cid) {
+	indexed := f.indexed()
+	var present []cid.Cid
+	f.lk.Lock()
+	for _, c := range ks {
+		if e, ok := f.items[string(c.Hash())]; ok {
+			f.removeElement(e)
+			present = append(present, c)
+		} else if !indexed {
+			// may not be indexed yet
+			present = append(present, c)
+		}
+	}
+	f.lk.Unlock()
+	f.delete(ctx, present)
+}
+
+// insert adds or refreshes an entry, the lock must be held.
+func (f *fetchCache) insert(entry fetchEntry) {
+	key := string(entry.c.Hash())
+	if e, ok := f.items[key]; ok {
+		f.size += int64(entry.size - e.Value.(fetchEntry).size)
+		e.Value = entry
+		f.ll.MoveToFront(e)
+		return
+	}
+	f.items[key] = f.ll.PushFront(entry)
+	f.size += int64(entry.size)
+}
+
+// removeElement drops an entry from the index, the lock must be held.
+func (f *fetchCache) removeElement(e *list.Element) {
+	entry := f.ll.Remove(e).(fetchEntry)
+	delete(f.items, string(entry.c.Hash()))
+	f.size -= int64(entry.size)
+}
+
+// evict deletes the least recently used blocks while over budget.
+func (f *fetchCache) evict(ctx context.Context) {
+	if f.max <= 0 {
+		return
+	}
+	var victims []cid.Cid
+	f.lk.Lock()
+	for f.size > f.max && f.ll.Len() > 0 {
+		e := f.ll.Back()
+		victims = append(victims, e.Value.(fetchEntry).c)
+		f.removeElement(e)
+	}
+	f.lk.Unlock()
+	f.delete(ctx, victims)
+}
+
+func (f *fetchCache) delete(ctx context.Context, ks []cid.Cid) {
+	if len(ks) == 0 {
+		return
+	}
+	if bd, ok := f.bs.(BatchDeleter); ok && len(ks) > 1 {
+		if err := bd.DeleteMany(ctx, ks); err != nil {
+			logger.Errorf("could not delete blocks from the fetch cache: %s", err)
+		}
+		return
+	}
+	for _, c := range ks {
+		if err := f.bs.DeleteBlock(ctx, c); err != nil {
+			logger.Debugf("could not delete block %s from the fetch cache: %s", c, err)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// Package gateway serves blocks of a BlockService over HTTP following the
+// trustless gateway conventions: GET /ipfs/{cid} answers with the raw block
+// (application/vnd.ipld.raw) or with the DAG below it as a CAR
+// (application/vnd.ipld.car).
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-blockservice"
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var logger = logging.Logger("blockservice/gateway")
+
+const (
+	RawContentType = "application/vnd.ipld.raw"
+	CarContentType = "application/vnd.ipld.car"
+
+	// LoadLevelHeader and LoadLevelParam select the load level of a
+	// request, by the names printed by blockservice.LoadLevel.String.
+	LoadLevelHeader = "X-Load-Level"
+	LoadLevelParam  = "load-level"
+
+	// content addressed responses never change
+	immutableCacheControl = "public, max-age=29030400, immutable"
+)
+
+// Config configures a gateway Handler.
+type Config struct {
+	// LoadLevel is used by requests that don't select one. Defaults to
+	// blockservice.LoadOfLocalTitanIpfs.
+	LoadLevel blockservice.LoadLevel
+	// Timeout bounds the time spent resolving a request, after which the
+	// gateway answers 504 Gateway Timeout, as it does when titan
+	// schedulers time out. Zero means no timeout.
+	Timeout time.Duration
+	// ExportOptions configures CAR responses.
+	ExportOptions blockservice.ExportOptions
+}
+
+type handler struct {
+	bs  blockservice.BlockService
+	cfg Config
+}
+
+// NewHandler returns an http.Handler serving the blocks of bs under /ipfs/.
+func NewHandler(bs blockservice.BlockService, cfg Config) http.Handler {
+	return &handler{bs: bs, cfg: cfg}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/ipfs/")
+	if p == r.URL.Path || p == "" || strings.Contains(p, "/") {
+		http.Error(w, "expected /ipfs/{cid}", http.StatusNotFound)
+		return
+	}
+	c, err := cid.Decode(p)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid cid: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	contentType, err := responseFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	level := h.cfg.LoadLevel
+	if s := loadLevelName(r); s != "" {
+		level, err = blockservice.ParseLoadLevel(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	etag := fmt.Sprintf("\"%s.%s\"", c, strings.TrimPrefix(contentType, "application/vnd.ipld."))
+	if inm := r.Header.Get("If-None-Match"); inm != "" && inm == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), blockservice.LoadLevelOfSign, level.Uint8())
+	if h.cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.cfg.Timeout)
+		defer cancel()
+	}
+
+	// resolve the root first so that failures map to a status code
+	blk, err := h.bs.GetBlock(ctx, c)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Etag", etag)
+	header.Set("Cache-Control", immutableCacheControl)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Vary", "Accept, "+LoadLevelHeader)
+
+	switch contentType {
+	case RawContentType:
+		header.Set("Content-Length", fmt.Sprint(len(blk.RawData())))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(blk.RawData())
+		}
+	case CarContentType:
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			opts := h.cfg.ExportOptions
+			// CARv2 would have to be buffered, stream CARv1
+			opts.Version = 1
+			if err := blockservice.ExportCAR(ctx, h.bs, []cid.Cid{c}, w, opts); err != nil {
+				// the status line is gone, the client sees a truncated CAR
+				logger.Errorf("exporting car for %s: %s", c, err)
+			}
+		}
+	}
+}
+
+// responseFormat picks the response content type from the format query
+// parameter or the Accept header, defaulting to raw blocks.
+func responseFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "":
+	case "raw":
+		return RawContentType, nil
+	case "car":
+		return CarContentType, nil
+	default:
+		return "", fmt.Errorf("unsupported format %q", f)
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return RawContentType, nil
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case RawContentType, "*/*", "application/*":
+			return RawContentType, nil
+		case CarContentType:
+			return CarContentType, nil
+		}
+	}
+	return "", fmt.Errorf("none of %q can be served, use %s or %s", accept, RawContentType, CarContentType)
+}
+
+func loadLevelName(r *http.Request) string {
+	if s := r.Header.Get(LoadLevelHeader); s != "" {
+		return s
+	}
+	return r.URL.Query().Get(LoadLevelParam)
+}
+
+// writeError answers with the status matching err: 404 for missing blocks,
+// 503 when the load level has no source available and 504 on timeouts.
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case ipld.IsNotFound(err):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, blockservice.ErrOffline):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	case errors.Is(err, context.Canceled):
+		// the client went away
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,161 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-blockservice/titan"
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/linguohua/titan/api"
+)
+
+func TestGateway(t *testing.T) {
+	ctx := context.Background()
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	exchbstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	bs := blockservice.New(bstore, offline.Exchange(exchbstore))
+
+	local := blocks.NewBlock([]byte("local"))
+	remote := blocks.NewBlock([]byte("remote"))
+	if err := bstore.Put(ctx, local); err != nil {
+		t.Fatal(err)
+	}
+	if err := exchbstore.Put(ctx, remote); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(NewHandler(bs, Config{LoadLevel: blockservice.LoadOfLocalIpfs}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name        string
+		path        string
+		header      http.Header
+		status      int
+		contentType string
+	}{
+		{"raw", "/ipfs/" + local.Cid().String(), http.Header{"Accept": {RawContentType}}, http.StatusOK, RawContentType},
+		{"raw by format", "/ipfs/" + local.Cid().String() + "?format=raw", nil, http.StatusOK, RawContentType},
+		{"car", "/ipfs/" + local.Cid().String(), http.Header{"Accept": {CarContentType}}, http.StatusOK, CarContentType},
+		{"remote", "/ipfs/" + remote.Cid().String(), nil, http.StatusOK, RawContentType},
+		{"local only", "/ipfs/" + blocks.NewBlock([]byte("missing")).Cid().String() + "?load-level=local", nil, http.StatusNotFound, ""},
+		{"unknown load level", "/ipfs/" + local.Cid().String(), http.Header{LoadLevelHeader: {"everywhere"}}, http.StatusBadRequest, ""},
+		{"not acceptable", "/ipfs/" + local.Cid().String(), http.Header{"Accept": {"text/html"}}, http.StatusNotAcceptable, ""},
+		{"invalid cid", "/ipfs/nope", nil, http.StatusBadRequest, ""},
+		{"offline", "/ipfs/" + remote.Cid().String() + "?load-level=titan", nil, http.StatusServiceUnavailable, ""},
+		{"not modified", "/ipfs/" + local.Cid().String(), http.Header{"If-None-Match": {"\"" + local.Cid().String() + ".raw\""}}, http.StatusNotModified, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+tc.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, resp.StatusCode)
+			}
+			if tc.contentType == "" {
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != tc.contentType {
+				t.Fatalf("expected content type %s, got %s", tc.contentType, ct)
+			}
+			if resp.Header.Get("Etag") == "" || resp.Header.Get("Cache-Control") != immutableCacheControl {
+				t.Fatal("expected caching headers on immutable content")
+			}
+		})
+	}
+}
+
+// timingOutService fails every block request like a titan scheduler lookup
+// running out of time.
+type timingOutService struct {
+	blockservice.BlockService
+}
+
+func (timingOutService) GetBlock(context.Context, cid.Cid) (blocks.Block, error) {
+	return nil, titan.ErrSchedulerTimeout
+}
+
+func TestGatewaySourceTimeout(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(timingOutService{}, Config{}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/ipfs/" + blocks.NewBlock([]byte("slow")).Cid().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected status %d, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+	}
+}
+
+// missingScheduler points requests for unknown at no edge node and the others
+// at edgeURL.
+type missingScheduler struct {
+	unknown string
+	edgeURL string
+}
+
+func (s *missingScheduler) GetDownloadInfoWithBlock(_ context.Context, c, _ string) (api.DownloadInfo, error) {
+	if c == s.unknown {
+		return api.DownloadInfo{}, nil
+	}
+	return api.DownloadInfo{URL: s.edgeURL, Token: "token"}, nil
+}
+
+func TestGatewayTitanMiss(t *testing.T) {
+	unknown := blocks.NewBlock([]byte("unknown to titan"))
+	unserved := blocks.NewBlock([]byte("not on the edge"))
+	edge := httptest.NewServer(http.NotFoundHandler())
+	defer edge.Close()
+
+	rpc := jsonrpc.NewServer()
+	rpc.Register("titan", &missingScheduler{unknown: unknown.Cid().String(), edgeURL: edge.URL})
+	mux := http.NewServeMux()
+	mux.Handle(titan.RPCProtocol, rpc)
+	sched := httptest.NewServer(mux)
+	defer sched.Close()
+	host, port, err := net.SplitHostPort(sched.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	titanCtx := context.WithValue(context.Background(), "TitanIps", []string{fmt.Sprintf("/ip4/%s/tcp/%s", host, port)})
+
+	bstore := blockstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	srv := httptest.NewUnstartedServer(NewHandler(blockservice.New(bstore, nil), Config{LoadLevel: blockservice.LoadOfOnlyTitan}))
+	srv.Config.BaseContext = func(net.Listener) context.Context { return titanCtx }
+	srv.Start()
+	defer srv.Close()
+
+	for _, b := range []blocks.Block{unknown, unserved} {
+		resp, err := http.Get(srv.URL + "/ipfs/" + b.Cid().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected status %d for %s, got %d", http.StatusNotFound, b.Cid(), resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package blockservice
+
+import (
+	"context"
+
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-verifcid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ipfs/go-blockservice/internal"
+	"github.com/ipfs/go-blockservice/titan"
+)
+
+// HaveChecker can be implemented by exchanges able to tell whether a block
+// is available from the network without transferring it, e.g. with bitswap
+// want-have messages. Bitswap itself does not implement it; exchanges that
+// don't are skipped by Has.
+type HaveChecker interface {
+	Have(ctx context.Context, c cid.Cid) (bool, error)
+}
+
+// Has reports whether the block can be resolved by the load level found in
+// ctx. The local blockstore is checked first; titan is asked through its
+// schedulers, so no block data is transferred.
+//
+// The exchange is only asked when it implements HaveChecker, which bitswap
+// does not. With a plain bitswap exchange, Has returns false for blocks held
+// only by peers; use GetBlock to find out whether the network can serve
+// them.
+func (s *blockService) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.Has", trace.WithAttributes(attribute.Stringer("CID", c)))
+	defer span.End()
+
+	ctx, done := s.life.begin(ctx)
+	if done == nil {
+		return false, ErrClosed
+	}
+	defer done()
+
+	f := s.fetcher()
+	return has(ctx, c, s.loader(f))
+}
+
+// GetSize returns the size of the block resolved by the load level found in
+// ctx. Local blocks are answered from the blockstore; neither titan nor
+// bitswap report sizes, so blocks missing locally are retrieved.
+func (s *blockService) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	ctx, span := internal.StartSpan(ctx, "blockService.GetSize", trace.WithAttributes(attribute.Stringer("CID", c)))
+	defer span.End()
+
+	ctx, done := s.life.begin(ctx)
+	if done == nil {
+		return -1, ErrClosed
+	}
+	defer done()
+
+	f := s.fetcher()
+	return getSize(ctx, c, s.loader(f))
+}
+
+func has(ctx context.Context, c cid.Cid, l loader) (bool, error) {
+	if err := verifcid.ValidateCid(c); err != nil {
+		return false, err
+	}
+	level, err := l.requestLevel(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, source := range level.sources() {
+		switch source {
+		case SourceLocal:
+			if l.cache.has(c) {
+				return true, nil
+			}
+			has, err := l.bs.Has(ctx, c)
+			if has || err != nil {
+				return has, err
+			}
+			if l.fetched != nil && l.fetched.has(ctx, c) {
+				return true, nil
+			}
+		case SourceTitan:
+			has, err := titan.HasBlockInTitan(ctx, c)
+			if err != nil {
+				logger.Debugf("titan has check for %s failed: %s", c, err)
+				continue
+			}
+			if has {
+				return true, nil
+			}
+		case SourceIpfs:
+			if l.fget == nil {
+				continue
+			}
+			hc, ok := haveChecker(l.fget())
+			if !ok {
+				continue
+			}
+			has, err := hc.Have(ctx, c)
+			if has || err != nil {
+				return has, err
+			}
+		}
+	}
+	return false, nil
+}
+
+func getSize(ctx context.Context, c cid.Cid, l loader) (int, error) {
+	if err := verifcid.ValidateCid(c); err != nil {
+		return -1, err
+	}
+	level, err := l.requestLevel(ctx)
+	if err != nil {
+		return -1, err
+	}
+
+	sources := level.sources()
+	if sources[0] == SourceLocal {
+		if blk, ok := l.cache.get(c); ok {
+			return len(blk.RawData()), nil
+		}
+		size, err := l.bs.GetSize(ctx, c)
+		if ipld.IsNotFound(err) && l.fetched != nil {
+			size, err = l.fetched.getSize(ctx, c)
+		}
+		if err == nil || !ipld.IsNotFound(err) || len(sources) == 1 {
+			return size, err
+		}
+	}
+
+	blk, err := getBlock(ctx, c, l)
+	if err != nil {
+		return -1, err
+	}
+	return len(blk.RawData()), nil
+}
+
+func haveChecker(f notifiableFetcher) (HaveChecker, bool) {
+	if w, ok := f.(notifiableFetcherWrapper); ok {
+		hc, ok := w.Fetcher.(HaveChecker)
+		return hc, ok
+	}
+	hc, ok := f.(HaveChecker)
+	return hc, ok
+}
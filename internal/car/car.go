@@ -0,0 +1,239 @@
+// Package car reads and writes CARv1 streams and CARv2 files without
+// indexes, as described in https://ipld.io/specs/transport/car/.
+package car
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+// pragma is the fixed prefix of a CARv2 file, a CARv1 style header holding
+// only {"version": 2}.
+var pragma = []byte{0x0a, 0xa1, 0x67, 'v', 'e', 'r', 's', 'i', 'o', 'n', 0x02}
+
+const v2HeaderSize = 40
+
+// maxSectionSize bounds the size of a single header or block section.
+const maxSectionSize = 32 << 20
+
+// ErrHashMismatch is returned by Reader.Next for blocks whose data does not
+// hash to their CID.
+var ErrHashMismatch = errors.New("block data does not match its CID")
+
+// Writer writes blocks to a CAR stream.
+type Writer struct {
+	dst     io.Writer
+	w       io.Writer // where sections go, dst or payload
+	version int
+
+	// CARv2 output is either patched in place or buffered until Close.
+	seeker  io.WriteSeeker
+	start   int64
+	payload *bytes.Buffer
+	size    uint64
+}
+
+// NewWriter writes the header of a CAR of the given version (1 or 2)
+// holding roots to w. A CARv2 is streamed when w is an io.WriteSeeker and
+// buffered in memory otherwise; in both cases it is only complete once
+// Close returns.
+func NewWriter(w io.Writer, roots []cid.Cid, version int) (*Writer, error) {
+	cw := &Writer{dst: w, w: w, version: version}
+	switch version {
+	case 1:
+	case 2:
+		if ws, ok := w.(io.WriteSeeker); ok {
+			start, err := ws.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			cw.seeker, cw.start = ws, start
+			if _, err := w.Write(pragma); err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(make([]byte, v2HeaderSize)); err != nil {
+				return nil, err
+			}
+		} else {
+			cw.payload = new(bytes.Buffer)
+			cw.w = cw.payload
+		}
+	default:
+		return nil, fmt.Errorf("unsupported car version %d", version)
+	}
+
+	if err := cw.writeSection(encodeHeader(roots)); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Put appends b to the CAR.
+func (w *Writer) Put(b blocks.Block) error {
+	return w.writeSection(b.Cid().Bytes(), b.RawData())
+}
+
+// Close finishes a CARv2. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.version != 2 {
+		return nil
+	}
+
+	header := make([]byte, v2HeaderSize)
+	// characteristics are left empty, there is no index
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(pragma)+v2HeaderSize))
+	binary.LittleEndian.PutUint64(header[24:], w.size)
+
+	if w.seeker != nil {
+		if _, err := w.seeker.Seek(w.start+int64(len(pragma)), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := w.seeker.Write(header); err != nil {
+			return err
+		}
+		_, err := w.seeker.Seek(0, io.SeekEnd)
+		return err
+	}
+
+	for _, p := range [][]byte{pragma, header, w.payload.Bytes()} {
+		if _, err := w.dst.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeSection(parts ...[]byte) error {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	var buf [binary.MaxVarintLen64]byte
+	l := binary.PutUvarint(buf[:], uint64(n))
+	if _, err := w.w.Write(buf[:l]); err != nil {
+		return err
+	}
+	for _, p := range parts {
+		if _, err := w.w.Write(p); err != nil {
+			return err
+		}
+	}
+	w.size += uint64(l + n)
+	return nil
+}
+
+// Reader reads blocks from a CARv1 stream or a CARv2 file.
+type Reader struct {
+	// Version is the version of the CAR being read.
+	Version uint64
+	// Roots are the roots found in the CARv1 header.
+	Roots []cid.Cid
+
+	r *bufio.Reader
+}
+
+// NewReader reads the CAR header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	h, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	switch h.version {
+	case 1:
+		return &Reader{Version: 1, Roots: h.roots, r: br}, nil
+	case 2:
+		header := make([]byte, v2HeaderSize)
+		if _, err := io.ReadFull(br, header); err != nil {
+			return nil, err
+		}
+		offset := binary.LittleEndian.Uint64(header[16:])
+		size := binary.LittleEndian.Uint64(header[24:])
+		read := uint64(len(pragma) + v2HeaderSize)
+		if offset < read {
+			return nil, fmt.Errorf("invalid car v2 data offset %d", offset)
+		}
+		if _, err := br.Discard(int(offset - read)); err != nil {
+			return nil, err
+		}
+		inner := bufio.NewReader(io.LimitReader(br, int64(size)))
+		h, err := readHeader(inner)
+		if err != nil {
+			return nil, err
+		}
+		if h.version != 1 {
+			return nil, fmt.Errorf("invalid car v2 payload version %d", h.version)
+		}
+		return &Reader{Version: 2, Roots: h.roots, r: inner}, nil
+	default:
+		return nil, fmt.Errorf("unsupported car version %d", h.version)
+	}
+}
+
+// Next returns the next block, after checking that its data hashes to its
+// CID, or io.EOF once the CAR is exhausted.
+func (r *Reader) Next() (blocks.Block, error) {
+	data, err := readSection(r.r)
+	if err != nil {
+		return nil, err
+	}
+	n, c, err := cid.CidFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	data = data[n:]
+
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !sum.Equals(c) {
+		return nil, fmt.Errorf("%s: %w", c, ErrHashMismatch)
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+type header struct {
+	version uint64
+	roots   []cid.Cid
+}
+
+func readHeader(r *bufio.Reader) (header, error) {
+	data, err := readSection(r)
+	if err == io.EOF {
+		return header{}, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return header{}, err
+	}
+	return decodeHeader(data)
+}
+
+func readSection(r *bufio.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	if l == 0 || l > maxSectionSize {
+		return nil, fmt.Errorf("invalid car section length %d", l)
+	}
+	data := make([]byte, l)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data, nil
+}
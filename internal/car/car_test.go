@@ -0,0 +1,113 @@
+package car
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+)
+
+func testBlocks() []blocks.Block {
+	return []blocks.Block{
+		blocks.NewBlock([]byte("beep")),
+		blocks.NewBlock([]byte("boop")),
+		blocks.NewBlock(bytes.Repeat([]byte("a"), 300)),
+	}
+}
+
+func writeCar(t *testing.T, w io.Writer, version int, blks []blocks.Block) {
+	cw, err := NewWriter(w, []cid.Cid{blks[0].Cid(), blks[1].Cid()}, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blks {
+		if err := cw.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readCar(t *testing.T, r io.Reader, version uint64, blks []blocks.Block) {
+	cr, err := NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Version != version {
+		t.Fatalf("expected version %d, got %d", version, cr.Version)
+	}
+	if len(cr.Roots) != 2 || cr.Roots[0] != blks[0].Cid() || cr.Roots[1] != blks[1].Cid() {
+		t.Fatalf("unexpected roots %v", cr.Roots)
+	}
+	for _, want := range blks {
+		got, err := cr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Cid() != want.Cid() || !bytes.Equal(got.RawData(), want.RawData()) {
+			t.Fatalf("expected block %s, got %s", want.Cid(), got.Cid())
+		}
+	}
+	if _, err := cr.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	blks := testBlocks()
+
+	t.Run("v1", func(t *testing.T) {
+		var buf bytes.Buffer
+		writeCar(t, &buf, 1, blks)
+		readCar(t, &buf, 1, blks)
+	})
+
+	t.Run("v2 buffered", func(t *testing.T) {
+		var buf bytes.Buffer
+		writeCar(t, &buf, 2, blks)
+		if !bytes.HasPrefix(buf.Bytes(), pragma) {
+			t.Fatal("missing car v2 pragma")
+		}
+		readCar(t, &buf, 2, blks)
+	})
+
+	t.Run("v2 seeker", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "test.car"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		writeCar(t, f, 2, blks)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		readCar(t, f, 2, blks)
+	})
+}
+
+func TestHashMismatch(t *testing.T) {
+	blks := testBlocks()
+	var buf bytes.Buffer
+	writeCar(t, &buf, 1, blks[:2])
+
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xff
+
+	cr, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cr.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cr.Next(); !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("expected ErrHashMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package car
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// The CAR header is a small dag-cbor map. Only the subset of CBOR needed to
+// write it canonically and to read any well formed header is implemented.
+
+const (
+	majUint   = 0
+	majBytes  = 2
+	majText   = 3
+	majArray  = 4
+	majMap    = 5
+	majTag    = 6
+	majSimple = 7
+
+	tagCid = 42
+)
+
+var errMalformedHeader = errors.New("malformed car header")
+
+func encodeHeader(roots []cid.Cid) []byte {
+	var buf []byte
+	buf = appendHead(buf, majMap, 2)
+	// dag-cbor sorts keys by length first
+	buf = appendHead(buf, majText, 5)
+	buf = append(buf, "roots"...)
+	buf = appendHead(buf, majArray, uint64(len(roots)))
+	for _, c := range roots {
+		b := c.Bytes()
+		buf = appendHead(buf, majTag, tagCid)
+		buf = appendHead(buf, majBytes, uint64(len(b)+1))
+		buf = append(buf, 0) // identity multibase prefix
+		buf = append(buf, b...)
+	}
+	buf = appendHead(buf, majText, 7)
+	buf = append(buf, "version"...)
+	buf = appendHead(buf, majUint, 1)
+	return buf
+}
+
+func appendHead(buf []byte, major byte, n uint64) []byte {
+	m := major << 5
+	switch {
+	case n < 24:
+		return append(buf, m|byte(n))
+	case n <= 0xff:
+		return append(buf, m|24, byte(n))
+	case n <= 0xffff:
+		var b [2]byte
+		binary.BigEndian.PutUint16(b[:], uint16(n))
+		return append(append(buf, m|25), b[:]...)
+	case n <= 0xffffffff:
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(n))
+		return append(append(buf, m|26), b[:]...)
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		return append(append(buf, m|27), b[:]...)
+	}
+}
+
+func decodeHeader(data []byte) (header, error) {
+	d := &decoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return header{}, err
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return header{}, errMalformedHeader
+	}
+
+	var h header
+	version, ok := m["version"].(uint64)
+	if !ok {
+		return header{}, fmt.Errorf("%w: missing version", errMalformedHeader)
+	}
+	h.version = version
+	if version != 1 {
+		return h, nil
+	}
+
+	roots, ok := m["roots"].([]interface{})
+	if !ok {
+		return header{}, fmt.Errorf("%w: missing roots", errMalformedHeader)
+	}
+	for _, r := range roots {
+		c, ok := r.(cid.Cid)
+		if !ok {
+			return header{}, fmt.Errorf("%w: root is not a CID", errMalformedHeader)
+		}
+		h.roots = append(h.roots, c)
+	}
+	return h, nil
+}
+
+// decoder decodes CBOR values into uint64, []byte, string,
+// []interface{}, map[string]interface{}, cid.Cid, bool and nil.
+type decoder struct {
+	data []byte
+	pos  int
+}
+
+const maxNesting = 16
+
+func (d *decoder) head() (byte, uint64, error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, errMalformedHeader
+	}
+	b := d.data[d.pos]
+	d.pos++
+	major, info := b>>5, b&0x1f
+
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("%w: indefinite lengths are not supported", errMalformedHeader)
+	}
+	if d.pos+size > len(d.data) {
+		return 0, 0, errMalformedHeader
+	}
+	var n uint64
+	for _, c := range d.data[d.pos : d.pos+size] {
+		n = n<<8 | uint64(c)
+	}
+	d.pos += size
+	return major, n, nil
+}
+
+func (d *decoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errMalformedHeader
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *decoder) value(depth int) (interface{}, error) {
+	if depth > maxNesting {
+		return nil, fmt.Errorf("%w: too deeply nested", errMalformedHeader)
+	}
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case majUint:
+		return n, nil
+	case majBytes:
+		return d.bytes(n)
+	case majText:
+		b, err := d.bytes(n)
+		return string(b), err
+	case majArray:
+		if n > uint64(len(d.data)) {
+			return nil, errMalformedHeader
+		}
+		arr := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case majMap:
+		if n > uint64(len(d.data)) {
+			return nil, errMalformedHeader
+		}
+		m := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: map key is not a string", errMalformedHeader)
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		}
+		return m, nil
+	case majTag:
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if n != tagCid {
+			return v, nil
+		}
+		b, ok := v.([]byte)
+		if !ok || len(b) == 0 || b[0] != 0 {
+			return nil, fmt.Errorf("%w: invalid CID", errMalformedHeader)
+		}
+		return cid.Cast(b[1:])
+	case majSimple:
+		switch n {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unsupported CBOR type %d", errMalformedHeader, major)
+}
@@ -0,0 +1,165 @@
+package blockservice
+
+import (
+	"context"
+	"time"
+
+	metrics "github.com/ipfs/go-metrics-interface"
+)
+
+// Source identifies where a block was resolved from.
+type Source uint8
+
+const (
+	SourceLocal  Source = iota // the local blockstore
+	SourceTitan                // a titan edge node
+	SourceIpfs                 // the exchange (usually bitswap)
+	SourceMemory               // the in-memory cache, see WithMemoryCache
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceLocal:
+		return "local"
+	case SourceTitan:
+		return "titan"
+	case SourceIpfs:
+		return "ipfs"
+	case SourceMemory:
+		return "memory"
+	default:
+		return "unknown"
+	}
+}
+
+const numSources = int(SourceMemory) + 1
+
+// Metrics receives measurements about block retrieval and storage. Every
+// method is labelled with the load level of the request and, where it
+// applies, the source that was consulted.
+//
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Requested records an attempt to resolve a block from source.
+	Requested(level LoadLevel, source Source)
+	// Hit records a block resolved from source.
+	Hit(level LoadLevel, source Source, size int, latency time.Duration)
+	// Miss records a source that does not have the requested block.
+	Miss(level LoadLevel, source Source, latency time.Duration)
+	// Failed records a source that could not be consulted.
+	Failed(level LoadLevel, source Source, err error)
+	// Written records n blocks written to the blockstore, remotely fetched
+	// or added through AddBlock and AddBlocks.
+	Written(level LoadLevel, n int, size int)
+	// WriteFailed records n blocks that could not be written to the
+	// blockstore.
+	WriteFailed(level LoadLevel, n int, err error)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) Requested(LoadLevel, Source)               {}
+func (noopMetrics) Hit(LoadLevel, Source, int, time.Duration) {}
+func (noopMetrics) Miss(LoadLevel, Source, time.Duration)     {}
+func (noopMetrics) Failed(LoadLevel, Source, error)           {}
+func (noopMetrics) Written(LoadLevel, int, int)               {}
+func (noopMetrics) WriteFailed(LoadLevel, int, error)         {}
+
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type sourceMetrics struct {
+	requests metrics.Counter
+	hits     metrics.Counter
+	misses   metrics.Counter
+	errors   metrics.Counter
+	bytes    metrics.Counter
+	latency  metrics.Histogram
+}
+
+type levelMetrics struct {
+	sources       [numSources]sourceMetrics
+	blocksWritten metrics.Counter
+	bytesWritten  metrics.Counter
+	writeFailures metrics.Counter
+}
+
+type ipfsMetrics struct {
+	levels [numLoadLevels]levelMetrics
+}
+
+// NewMetrics returns a Metrics backed by go-metrics-interface. Metrics are
+// created under the "blockservice" sub scope of the scope found in ctx, one
+// set per load level and source, and only become visible once an
+// implementation (e.g. go-metrics-prometheus) has been injected.
+func NewMetrics(ctx context.Context) Metrics {
+	ctx = metrics.CtxSubScope(ctx, "blockservice")
+
+	m := &ipfsMetrics{}
+	for l := range m.levels {
+		lctx := metrics.CtxSubScope(ctx, LoadLevel(l).metricName())
+		lm := &m.levels[l]
+		for s := range lm.sources {
+			name := Source(s).String()
+			sm := &lm.sources[s]
+			sm.requests = metrics.NewCtx(lctx, name+".requests_total", "Number of block requests sent to "+name).Counter()
+			sm.hits = metrics.NewCtx(lctx, name+".hits_total", "Number of blocks resolved from "+name).Counter()
+			sm.misses = metrics.NewCtx(lctx, name+".misses_total", "Number of blocks "+name+" did not have").Counter()
+			sm.errors = metrics.NewCtx(lctx, name+".errors_total", "Number of failed requests to "+name).Counter()
+			sm.bytes = metrics.NewCtx(lctx, name+".bytes_total", "Number of bytes received from "+name).Counter()
+			sm.latency = metrics.NewCtx(lctx, name+".latency_seconds", "Latency of block requests to "+name).Histogram(latencyBuckets)
+		}
+		lm.blocksWritten = metrics.NewCtx(lctx, "blockstore.written_blocks_total", "Number of blocks written to the blockstore").Counter()
+		lm.bytesWritten = metrics.NewCtx(lctx, "blockstore.written_bytes_total", "Number of bytes written to the blockstore").Counter()
+		lm.writeFailures = metrics.NewCtx(lctx, "blockstore.write_failures_total", "Number of blocks that could not be written to the blockstore").Counter()
+	}
+	return m
+}
+
+func (m *ipfsMetrics) source(level LoadLevel, source Source) *sourceMetrics {
+	if int(level) >= numLoadLevels || int(source) >= numSources {
+		return nil
+	}
+	return &m.levels[level].sources[source]
+}
+
+func (m *ipfsMetrics) Requested(level LoadLevel, source Source) {
+	if sm := m.source(level, source); sm != nil {
+		sm.requests.Inc()
+	}
+}
+
+func (m *ipfsMetrics) Hit(level LoadLevel, source Source, size int, latency time.Duration) {
+	if sm := m.source(level, source); sm != nil {
+		sm.hits.Inc()
+		sm.bytes.Add(float64(size))
+		sm.latency.Observe(latency.Seconds())
+	}
+}
+
+func (m *ipfsMetrics) Miss(level LoadLevel, source Source, latency time.Duration) {
+	if sm := m.source(level, source); sm != nil {
+		sm.misses.Inc()
+		sm.latency.Observe(latency.Seconds())
+	}
+}
+
+func (m *ipfsMetrics) Failed(level LoadLevel, source Source, _ error) {
+	if sm := m.source(level, source); sm != nil {
+		sm.errors.Inc()
+	}
+}
+
+func (m *ipfsMetrics) Written(level LoadLevel, n int, size int) {
+	if int(level) >= numLoadLevels {
+		return
+	}
+	m.levels[level].blocksWritten.Add(float64(n))
+	m.levels[level].bytesWritten.Add(float64(size))
+}
+
+func (m *ipfsMetrics) WriteFailed(level LoadLevel, n int, _ error) {
+	if int(level) >= numLoadLevels {
+		return
+	}
+	m.levels[level].writeFailures.Add(float64(n))
+}
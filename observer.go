@@ -0,0 +1,69 @@
+package blockservice
+
+import (
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+)
+
+// BlockServiceObserver is notified about blocks passing through a
+// BlockService. Callbacks are invoked synchronously from the goroutine
+// serving the request, possibly concurrently, and must not block.
+type BlockServiceObserver interface {
+	// OnBlockFetched is called for every block resolved by a load level,
+	// with the source that provided it.
+	OnBlockFetched(c cid.Cid, source Source, latency time.Duration, size int)
+	// OnBlockAdded is called for every block written by AddBlock(s).
+	OnBlockAdded(c cid.Cid, size int)
+	// OnBlockDeleted is called for every block removed by DeleteBlock.
+	OnBlockDeleted(c cid.Cid)
+	// OnFetchFailed is called when a remote source could not provide a
+	// block. Misses of the local blockstore and the memory cache are not
+	// reported.
+	OnFetchFailed(c cid.Cid, source Source, err error)
+	// OnWriteFailed is called for every remotely fetched block that could
+	// not be written to the blockstore.
+	OnWriteFailed(c cid.Cid, err error)
+}
+
+// WithObserver registers o to be notified about block retrieval and storage.
+// It may be given multiple times.
+func WithObserver(o BlockServiceObserver) Option {
+	return func(s *blockService) {
+		if o != nil {
+			s.observers = append(s.observers, o)
+		}
+	}
+}
+
+type observers []BlockServiceObserver
+
+func (os observers) fetched(c cid.Cid, source Source, latency time.Duration, size int) {
+	for _, o := range os {
+		o.OnBlockFetched(c, source, latency, size)
+	}
+}
+
+func (os observers) added(c cid.Cid, size int) {
+	for _, o := range os {
+		o.OnBlockAdded(c, size)
+	}
+}
+
+func (os observers) deleted(c cid.Cid) {
+	for _, o := range os {
+		o.OnBlockDeleted(c)
+	}
+}
+
+func (os observers) failed(c cid.Cid, source Source, err error) {
+	for _, o := range os {
+		o.OnFetchFailed(c, source, err)
+	}
+}
+
+func (os observers) writeFailed(c cid.Cid, err error) {
+	for _, o := range os {
+		o.OnWriteFailed(c, err)
+	}
+}
@@ -0,0 +1,146 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	exchange "github.com/ipfs/go-ipfs-exchange-interface"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ipfs/go-blockservice/titan"
+)
+
+// ErrOffline is matched by the errors of requests whose load level needs
+// sources that are not available: titan without schedulers in the context,
+// or ipfs without an exchange.
+var ErrOffline = errors.New("blockservice: offline")
+
+// OfflineError reports the sources of a load level that are not available.
+type OfflineError struct {
+	Level       LoadLevel
+	Unavailable []Source
+}
+
+func (e *OfflineError) Error() string {
+	names := make([]string, len(e.Unavailable))
+	for i, s := range e.Unavailable {
+		names[i] = s.String()
+	}
+	return fmt.Sprintf("%s: %s unavailable for load level %s", ErrOffline, strings.Join(names, ", "), e.Level)
+}
+
+// Is makes errors.Is(err, ErrOffline) match every OfflineError.
+func (e *OfflineError) Is(target error) bool {
+	return target == ErrOffline
+}
+
+// WithOfflineDegrade decides what happens to load levels with unavailable
+// sources. By default they are degraded to the level made of the sources
+// that are available, e.g. local-titan-ipfs runs as local-ipfs when no titan
+// scheduler is configured; requests fail with an OfflineError only when no
+// source is left. With enabled false, any unavailable source fails the
+// request.
+func WithOfflineDegrade(enabled bool) Option {
+	return func(s *blockService) {
+		s.strictLevels = !enabled
+	}
+}
+
+// requestLevel returns the load level of the request found in ctx, degraded
+// to the sources available.
+func (l *loader) requestLevel(ctx context.Context) (LoadLevel, error) {
+	level, err := loadLevelFromContext(ctx)
+	if err != nil {
+		return level, err
+	}
+	return l.availableLevel(ctx, level)
+}
+
+// availableLevel returns level restricted to the sources available to the
+// request.
+func (l *loader) availableLevel(ctx context.Context, level LoadLevel) (LoadLevel, error) {
+	sources := level.sources()
+	available := make([]Source, 0, len(sources))
+	var unavailable []Source
+	for _, s := range sources {
+		if (s == SourceTitan && !titan.Configured(ctx)) || (s == SourceIpfs && l.fget == nil) {
+			unavailable = append(unavailable, s)
+			continue
+		}
+		available = append(available, s)
+	}
+	if len(unavailable) == 0 {
+		return level, nil
+	}
+
+	degraded, ok := levelOf(available)
+	if !ok || l.strictLevels {
+		return level, &OfflineError{Level: level, Unavailable: unavailable}
+	}
+	trace.SpanFromContext(ctx).AddEvent("degraded", trace.WithAttributes(
+		attribute.Stringer("From", level),
+		attribute.Stringer("To", degraded),
+	))
+	return degraded, nil
+}
+
+// levelOf returns the load level consulting exactly sources.
+func levelOf(sources []Source) (LoadLevel, bool) {
+	for l := 0; l < numLoadLevels; l++ {
+		ls := LoadLevel(l).sources()
+		if len(ls) != len(sources) {
+			continue
+		}
+		match := true
+		for i := range ls {
+			if ls[i] != sources[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return LoadLevel(l), true
+		}
+	}
+	return 0, false
+}
+
+// ExchangeSetter is implemented by the BlockServices returned by New, to
+// attach or swap the exchange at runtime. Callers type-assert to use it.
+type ExchangeSetter interface {
+	// SetExchange attaches rem, or detaches the exchange when rem is nil,
+	// and returns the previous exchange.
+	SetExchange(rem exchange.Interface) exchange.Interface
+}
+
+var _ ExchangeSetter = (*blockService)(nil)
+
+// SetExchange attaches rem to the service, or detaches the exchange when rem
+// is nil, and returns the previous exchange. Requests already running keep
+// the exchange they started with; closing the previous exchange is up to the
+// caller. Sessions created earlier are not affected.
+func (s *blockService) SetExchange(rem exchange.Interface) exchange.Interface {
+	s.exLk.Lock()
+	defer s.exLk.Unlock()
+	old := s.exchange
+	s.exchange = rem
+	return old
+}
+
+func (s *blockService) currentExchange() exchange.Interface {
+	s.exLk.RLock()
+	defer s.exLk.RUnlock()
+	return s.exchange
+}
+
+// fetcher returns the fetcher factory of a request, nil when offline.
+func (s *blockService) fetcher() func() notifiableFetcher {
+	ex := s.currentExchange()
+	if ex == nil {
+		return nil
+	}
+	return func() notifiableFetcher { return ex }
+}
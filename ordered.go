@@ -0,0 +1,126 @@
+package blockservice
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ipfs/go-blockservice/internal"
+)
+
+// Result is the outcome of fetching a single block.
+type Result struct {
+	Cid cid.Cid
+	// Block is nil when Err is set.
+	Block blocks.Block
+	Err   error
+}
+
+// OrderedGetter is implemented by the BlockServices returned by New and by
+// sessions, to fetch blocks concurrently while emitting them in request
+// order. Callers type-assert to use it.
+type OrderedGetter interface {
+	// GetBlocksOrdered fetches the given blocks concurrently and returns
+	// one Result per CID, in the order of ks.
+	GetBlocksOrdered(ctx context.Context, ks []cid.Cid) <-chan Result
+}
+
+var (
+	_ OrderedGetter = (*blockService)(nil)
+	_ OrderedGetter = (*Session)(nil)
+)
+
+const defaultReorderWindow = 32
+
+// WithReorderWindow sets how many blocks GetBlocksOrdered fetches ahead of
+// the next one to emit, 32 by default.
+func WithReorderWindow(n int) Option {
+	return func(s *blockService) {
+		s.reorderWindow = n
+	}
+}
+
+// GetBlocksOrdered fetches ks concurrently according to the load level found
+// in ctx and emits one Result per CID, in the order of ks. Blocks that could
+// not be fetched are reported with their error at their position. The
+// channel is closed early when ctx is done.
+func (s *blockService) GetBlocksOrdered(ctx context.Context, ks []cid.Cid) <-chan Result {
+	ctx, span := internal.StartSpan(ctx, "blockService.GetBlocksOrdered", trace.WithAttributes(attribute.Int("Count", len(ks))))
+	defer span.End()
+
+	ctx, done := s.life.begin(ctx)
+	if done == nil {
+		return closedResults()
+	}
+
+	f := s.fetcher()
+	l := s.loader(f)
+	l.release = done
+	return getBlocksOrdered(ctx, ks, l)
+}
+
+// GetBlocksOrdered gets blocks in the context of a request session, in the
+// order of ks. See OrderedGetter.
+func (s *Session) GetBlocksOrdered(ctx context.Context, ks []cid.Cid) <-chan Result {
+	ctx, span := internal.StartSpan(ctx, "Session.GetBlocksOrdered", trace.WithAttributes(attribute.Int("Count", len(ks))))
+	defer span.End()
+
+	ctx, done := s.base.life.begin(ctx)
+	if done == nil {
+		return closedResults()
+	}
+	l := s.loader()
+	l.release = done
+	return getBlocksOrdered(ctx, ks, l)
+}
+
+// getBlocksOrdered keeps up to the reorder window of fetches running ahead
+// of the next result to emit, so results wait for at most that many blocks.
+func getBlocksOrdered(ctx context.Context, ks []cid.Cid, l loader) <-chan Result {
+	window := l.reorderWindow
+	if window <= 0 {
+		window = defaultReorderWindow
+	}
+
+	out := make(chan Result)
+	go func() {
+		defer l.finish()
+		defer close(out)
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		pending := make([]chan Result, window)
+		fetch := func(i int) {
+			res := make(chan Result, 1)
+			pending[i%window] = res
+			go func(c cid.Cid) {
+				blk, err := getBlock(ctx, c, l) // hash security
+				res <- Result{Cid: c, Block: blk, Err: err}
+			}(ks[i])
+		}
+		for i := 0; i < len(ks) && i < window; i++ {
+			fetch(i)
+		}
+
+		for i := range ks {
+			var r Result
+			select {
+			case r = <-pending[i%window]:
+			case <-ctx.Done():
+				return
+			}
+			if next := i + window; next < len(ks) {
+				fetch(next)
+			}
+			select {
+			case out <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
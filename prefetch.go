@@ -0,0 +1,253 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	blocks "github.com/ipfs/go-block-format"
+	cid "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-verifcid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ipfs/go-blockservice/internal"
+	"github.com/ipfs/go-blockservice/titan"
+)
+
+const defaultPrefetchConcurrency = 32
+
+// PrefetchOptions configures Prefetch.
+type PrefetchOptions struct {
+	// MaxDepth limits how many levels of links below the root are
+	// followed. Zero means no limit.
+	MaxDepth int
+	// Concurrency is the number of blocks requested at once. Defaults
+	// to 32.
+	Concurrency int
+	// Decoder decodes fetched blocks to discover their links. Defaults to
+	// a decoder handling dag-pb and raw blocks that leaves other codecs to
+	// ipld.DefaultBlockDecoder; blocks it can't decode are treated as
+	// leaves.
+	Decoder ipld.BlockDecoder
+}
+
+// Prefetch walks the DAG below root level by level through a session of bs,
+// using the load level found in ctx, and stores every block it fetches in
+// the local blockstore so that later GetBlock calls are local hits. Blocks
+// that can't be found are skipped along with their children.
+func Prefetch(ctx context.Context, bs BlockService, root cid.Cid, opts PrefetchOptions) error {
+	ctx, span := internal.StartSpan(ctx, "Prefetch", trace.WithAttributes(attribute.Stringer("Root", root)))
+	defer span.End()
+
+	ses := NewSession(ctx, bs)
+	l := prefetchLoader(bs)
+	l.level, _ = loadLevelFromContext(ctx)
+	fetched := 0
+	err := walkDAG(ctx, ses, []cid.Cid{root}, opts, func(_ []cid.Cid, blks []blocks.Block) error {
+		fetched += len(blks)
+		return l.storeMissing(ctx, blks)
+	})
+	span.SetAttributes(attribute.Int("Fetched", fetched))
+	return err
+}
+
+// PrefetchFromTitan fetches the DAG below root from a titan edge node as a
+// single CAR stream and stores its blocks like blocks fetched from titan,
+// in the fetch cache when one is configured. Only blocks reached by walking
+// the DAG from root, parents first, are accepted; the stream is aborted on
+// any other block. If the edge node only serves single blocks, it falls
+// back to Prefetch with LoadOfLocalTitan.
+func PrefetchFromTitan(ctx context.Context, bs BlockService, root cid.Cid, opts PrefetchOptions) error {
+	ctx, span := internal.StartSpan(ctx, "PrefetchFromTitan", trace.WithAttributes(attribute.Stringer("Root", root)))
+	defer span.End()
+
+	if err := verifcid.ValidateCid(root); err != nil { // hash security
+		return err
+	}
+	l := prefetchLoader(bs)
+	l.level = LoadOfLocalTitan
+	if err := l.acquire(ctx, SourceTitan, 1); err != nil {
+		return err
+	}
+	tctx := l.titanContext(ctx)
+
+	batchSize := opts.Concurrency
+	if batchSize <= 0 {
+		batchSize = defaultPrefetchConcurrency
+	}
+	filter := newDAGFilter(root, opts)
+	batch := make([]blocks.Block, 0, batchSize)
+	err := titan.GetCarFromTitan(tctx, root, opts.MaxDepth, func(b blocks.Block) error {
+		if ok, err := filter.accept(b); !ok || err != nil {
+			return err
+		}
+		batch = append(batch, b)
+		if len(batch) < batchSize {
+			return nil
+		}
+		err := l.storeMissing(ctx, batch)
+		batch = batch[:0]
+		return err
+	})
+	if errors.Is(err, titan.ErrCarNotSupported) {
+		logger.Debugf("titan edge can't serve a car for %s, fetching blocks one by one", root)
+		span.AddEvent("fallback", trace.WithAttributes(attribute.String("To", "blocks")))
+		return Prefetch(context.WithValue(ctx, LoadLevelOfSign, LoadOfLocalTitan.Uint8()), bs, root, opts)
+	}
+	if err != nil {
+		return err
+	}
+	return l.storeMissing(ctx, batch)
+}
+
+// prefetchLoader returns the loader storing the blocks prefetched for bs.
+func prefetchLoader(bs BlockService) loader {
+	if s, ok := bs.(*blockService); ok {
+		return s.loader(nil)
+	}
+	return loader{bs: bs.Blockstore(), metrics: noopMetrics{}}
+}
+
+// dagFilter accepts the blocks of a CAR stream belonging to the DAG below
+// its root, each parent before its children.
+type dagFilter struct {
+	root     cid.Cid
+	dec      ipld.BlockDecoder
+	maxDepth int
+	reached  map[cid.Cid]int // depth of the CIDs linked so far
+	accepted *cid.Set
+}
+
+func newDAGFilter(root cid.Cid, opts PrefetchOptions) *dagFilter {
+	dec := opts.Decoder
+	if dec == nil {
+		dec = defaultDecoder
+	}
+	return &dagFilter{
+		root:     root,
+		dec:      dec,
+		maxDepth: opts.MaxDepth,
+		reached:  map[cid.Cid]int{root: 0},
+		accepted: cid.NewSet(),
+	}
+}
+
+// accept reports whether b should be stored. Repeated blocks are skipped,
+// blocks outside of the DAG fail the stream.
+func (f *dagFilter) accept(b blocks.Block) (bool, error) {
+	c := b.Cid()
+	if err := verifcid.ValidateCid(c); err != nil { // hash security
+		return false, fmt.Errorf("unsafe CID %s from titan: %w", c, err)
+	}
+	depth, ok := f.reached[c]
+	if !ok {
+		return false, fmt.Errorf("block %s from titan is not part of the DAG below %s", c, f.root)
+	}
+	if !f.accepted.Visit(c) {
+		return false, nil
+	}
+	if f.maxDepth > 0 && depth >= f.maxDepth {
+		return true, nil
+	}
+	for _, l := range links(f.dec, b) {
+		if _, ok := f.reached[l]; !ok {
+			f.reached[l] = depth + 1
+		}
+	}
+	return true, nil
+}
+
+// walkDAG fetches the DAGs below roots breadth first, opts.Concurrency
+// blocks at a time, and hands every batch of requested CIDs and the blocks
+// found for them to visit.
+func walkDAG(ctx context.Context, bg BlockGetter, roots []cid.Cid, opts PrefetchOptions, visit func([]cid.Cid, []blocks.Block) error) error {
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultPrefetchConcurrency
+	}
+	dec := opts.Decoder
+	if dec == nil {
+		dec = defaultDecoder
+	}
+
+	seen := cid.NewSet()
+	var frontier []cid.Cid
+	for _, c := range roots {
+		if seen.Visit(c) {
+			frontier = append(frontier, c)
+		}
+	}
+
+	for depth := 0; len(frontier) != 0; depth++ {
+		var next []cid.Cid
+		for start := 0; start < len(frontier); start += concurrency {
+			end := start + concurrency
+			if end > len(frontier) {
+				end = len(frontier)
+			}
+
+			var batch []blocks.Block
+			for b := range bg.GetBlocks(ctx, frontier[start:end]) {
+				batch = append(batch, b)
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := visit(frontier[start:end], batch); err != nil {
+				return err
+			}
+
+			if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+				continue
+			}
+			for _, b := range batch {
+				for _, c := range links(dec, b) {
+					if seen.Visit(c) {
+						next = append(next, c)
+					}
+				}
+			}
+		}
+		frontier = next
+	}
+	return nil
+}
+
+// links returns the CIDs b links to, or nothing if b can't be decoded.
+func links(dec ipld.BlockDecoder, b blocks.Block) []cid.Cid {
+	if b.Cid().Prefix().Codec == cid.Raw {
+		return nil
+	}
+	nd, err := dec.Decode(b)
+	if err != nil {
+		logger.Debugf("cannot decode %s, treating it as a leaf: %s", b.Cid(), err)
+		return nil
+	}
+	ls := nd.Links()
+	ks := make([]cid.Cid, 0, len(ls))
+	for _, l := range ls {
+		ks = append(ks, l.Cid)
+	}
+	return ks
+}
+
+// storeMissing writes the blocks not yet stored locally, such as those
+// served by titan, like other fetched blocks.
+func (l *loader) storeMissing(ctx context.Context, blks []blocks.Block) error {
+	var toput []blocks.Block
+	for _, b := range blks {
+		has, err := l.bs.Has(ctx, b.Cid())
+		if err != nil {
+			return err
+		}
+		if !has && !(l.fetched != nil && l.fetched.has(ctx, b.Cid())) {
+			toput = append(toput, b)
+		}
+	}
+	if len(toput) == 0 {
+		return nil
+	}
+	return l.putFetched(ctx, toput...)
+}
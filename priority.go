@@ -0,0 +1,266 @@
+package blockservice
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+)
+
+// Priority orders remote fetches competing for the fetch queue.
+type Priority int8
+
+const (
+	PriorityBackground Priority = iota - 1 // runs when nothing else waits, may be preempted
+	PriorityNormal                         // the default
+	PriorityHigh                           // served before anything else
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityBackground:
+		return "background"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "unknown"
+	}
+}
+
+type priorityKey struct{}
+
+// WithPriority returns a context whose remote fetches are queued with p.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFromContext returns the priority set by WithPriority, defaulting
+// to PriorityNormal.
+func PriorityFromContext(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+// PriorityFetcher is implemented by exchanges able to prioritize their
+// wants. When the exchange supports it, blocks fetched from ipfs are
+// requested with the priority of the request.
+type PriorityFetcher interface {
+	GetBlockWithPriority(ctx context.Context, c cid.Cid, p Priority) (blocks.Block, error)
+	GetBlocksWithPriority(ctx context.Context, ks []cid.Cid, p Priority) (<-chan blocks.Block, error)
+}
+
+func priorityFetcher(f notifiableFetcher) (PriorityFetcher, bool) {
+	if w, ok := f.(notifiableFetcherWrapper); ok {
+		pf, ok := w.Fetcher.(PriorityFetcher)
+		return pf, ok
+	}
+	pf, ok := f.(PriorityFetcher)
+	return pf, ok
+}
+
+const defaultFetchConcurrency = 32
+
+// WithFetchConcurrency bounds the number of fetches from titan and the
+// exchange running at once, 32 by default. A batch requested from the
+// exchange takes a single slot for as long as its blocks arrive. Waiting
+// fetches are started by priority. A value <= 0 removes the bound, and with
+// it priorities.
+func WithFetchConcurrency(n int) Option {
+	return func(s *blockService) {
+		s.queue = newFetchQueue(n)
+	}
+}
+
+// fetchQueue hands out a fixed number of fetch slots, highest priority
+// first and in arrival order within a priority. Background fetches holding
+// a slot are cancelled when a more urgent fetch would have to wait, and
+// queued again.
+type fetchQueue struct {
+	lk        sync.Mutex
+	free      int
+	seq       uint64
+	waiting   waiters
+	running   map[*ticket]struct{}
+	urgent    int // waiting fetches above background priority
+	preempted int // running background fetches told to stop
+}
+
+type ticket struct {
+	priority  Priority
+	seq       uint64
+	index     int
+	ready     chan struct{}
+	granted   bool
+	preempted bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+func newFetchQueue(n int) *fetchQueue {
+	if n <= 0 {
+		return nil
+	}
+	return &fetchQueue{free: n, running: make(map[*ticket]struct{})}
+}
+
+// do runs fn once a slot is available. An fn failing because it was
+// preempted is run again when its turn comes back, unless ctx is done by
+// then.
+func (q *fetchQueue) do(ctx context.Context, p Priority, fn func(context.Context) error) error {
+	if q == nil {
+		return fn(ctx)
+	}
+	for {
+		t, err := q.acquire(ctx, p)
+		if err != nil {
+			return err
+		}
+		err = fn(t.ctx)
+		q.release(t)
+		// t.preempted is no longer written once released
+		if err == nil || !t.preempted || ctx.Err() != nil || !errors.Is(err, context.Canceled) {
+			return err
+		}
+		logger.Debugf("background fetch preempted, queueing again")
+	}
+}
+
+// hold takes a slot for a fetch streaming its results, which runs with the
+// returned context and calls done once it is over. done reports whether the
+// fetch was preempted and should be queued again.
+func (q *fetchQueue) hold(ctx context.Context, p Priority) (context.Context, func() bool, error) {
+	if q == nil {
+		return ctx, func() bool { return false }, nil
+	}
+	t, err := q.acquire(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t.ctx, func() bool {
+		q.release(t)
+		return t.preempted && ctx.Err() == nil
+	}, nil
+}
+
+func (q *fetchQueue) acquire(ctx context.Context, p Priority) (*ticket, error) {
+	q.lk.Lock()
+	q.seq++
+	t := &ticket{priority: p, seq: q.seq, ready: make(chan struct{})}
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	if q.free > 0 && len(q.waiting) == 0 {
+		q.free--
+		q.grant(t)
+		q.lk.Unlock()
+		return t, nil
+	}
+	heap.Push(&q.waiting, t)
+	if p > PriorityBackground {
+		q.urgent++
+		q.preempt()
+	}
+	q.lk.Unlock()
+
+	select {
+	case <-t.ready:
+		return t, nil
+	case <-ctx.Done():
+		q.lk.Lock()
+		if t.granted {
+			q.lk.Unlock()
+			q.release(t)
+		} else {
+			heap.Remove(&q.waiting, t.index)
+			if p > PriorityBackground {
+				q.urgent--
+			}
+			q.lk.Unlock()
+			t.cancel()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// grant hands a slot to t, the lock must be held.
+func (q *fetchQueue) grant(t *ticket) {
+	t.granted = true
+	q.running[t] = struct{}{}
+	close(t.ready)
+}
+
+// preempt cancels the most recent background fetch while there are more
+// urgent fetches waiting than background fetches already told to stop. The
+// lock must be held.
+func (q *fetchQueue) preempt() {
+	for q.urgent > q.preempted {
+		var victim *ticket
+		for t := range q.running {
+			if t.priority == PriorityBackground && !t.preempted && (victim == nil || t.seq > victim.seq) {
+				victim = t
+			}
+		}
+		if victim == nil {
+			return
+		}
+		victim.preempted = true
+		q.preempted++
+		victim.cancel()
+	}
+}
+
+func (q *fetchQueue) release(t *ticket) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	t.cancel()
+	delete(q.running, t)
+	if t.preempted {
+		q.preempted--
+	}
+	if len(q.waiting) == 0 {
+		q.free++
+		return
+	}
+	next := heap.Pop(&q.waiting).(*ticket)
+	if next.priority > PriorityBackground {
+		q.urgent--
+	}
+	q.grant(next)
+}
+
+// waiters is a heap of tickets, highest priority and oldest first.
+type waiters []*ticket
+
+func (w waiters) Len() int { return len(w) }
+
+func (w waiters) Less(i, j int) bool {
+	if w[i].priority != w[j].priority {
+		return w[i].priority > w[j].priority
+	}
+	return w[i].seq < w[j].seq
+}
+
+func (w waiters) Swap(i, j int) {
+	w[i], w[j] = w[j], w[i]
+	w[i].index = i
+	w[j].index = j
+}
+
+func (w *waiters) Push(x interface{}) {
+	t := x.(*ticket)
+	t.index = len(*w)
+	*w = append(*w, t)
+}
+
+func (w *waiters) Pop() interface{} {
+	old := *w
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*w = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,178 @@
+package blockservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned by fail-fast rate limits when a source has
+// exhausted its budget.
+var ErrRateLimited = errors.New("blockservice: rate limit exceeded")
+
+// RatePolicy decides what happens to requests exceeding a rate limit.
+type RatePolicy uint8
+
+const (
+	RateLimitWait     RatePolicy = iota // block until the budget allows the request
+	RateLimitFailFast                   // fail with ErrRateLimited
+)
+
+// RateLimit bounds the traffic sent to a single source. Zero values leave
+// the corresponding dimension unlimited.
+type RateLimit struct {
+	// RequestsPerSecond bounds the number of blocks requested per second.
+	RequestsPerSecond float64
+	// RequestBurst is the number of requests allowed at once, one second
+	// worth of requests by default.
+	RequestBurst int
+	// BytesPerSecond bounds the block data received per second.
+	BytesPerSecond float64
+	// ByteBurst is the number of bytes allowed at once, one second worth of
+	// bytes by default.
+	ByteBurst int
+	// Policy applies to requests made while the budget is exhausted. Data
+	// already being received from titan is always throttled by waiting.
+	Policy RatePolicy
+}
+
+// WithRateLimit limits the requests sent to, and the data received from,
+// titan or the exchange. Local and memory reads are never limited.
+func WithRateLimit(source Source, limit RateLimit) Option {
+	return func(s *blockService) {
+		if source != SourceTitan && source != SourceIpfs {
+			return
+		}
+		s.limits[source] = newRateLimiter(limit)
+	}
+}
+
+// rateLimiter holds the request and byte budgets of a source.
+type rateLimiter struct {
+	requests *tokenBucket
+	bytes    *tokenBucket
+	policy   RatePolicy
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	r := &rateLimiter{policy: limit.Policy}
+	if limit.RequestsPerSecond > 0 {
+		r.requests = newTokenBucket(limit.RequestsPerSecond, limit.RequestBurst)
+	}
+	if limit.BytesPerSecond > 0 {
+		r.bytes = newTokenBucket(limit.BytesPerSecond, limit.ByteBurst)
+	}
+	return r
+}
+
+// acquire takes n requests from the budget. It also holds requests back
+// while the byte budget is overdrawn, as the size of blocks is only known
+// once they have been received.
+func (r *rateLimiter) acquire(ctx context.Context, n int) error {
+	if r == nil {
+		return nil
+	}
+	if r.policy == RateLimitFailFast {
+		if !r.bytes.allow(0) || !r.requests.allow(float64(n)) {
+			return ErrRateLimited
+		}
+		return nil
+	}
+	if err := sleep(ctx, r.requests.take(float64(n))); err != nil {
+		return err
+	}
+	return sleep(ctx, r.bytes.take(0))
+}
+
+// charge records n bytes received outside of a throttled reader.
+func (r *rateLimiter) charge(n int) {
+	if r != nil {
+		r.bytes.take(float64(n))
+	}
+}
+
+// WaitN implements titan.ReadLimiter, throttling edge downloads.
+func (r *rateLimiter) WaitN(ctx context.Context, n int) error {
+	return sleep(ctx, r.bytes.take(float64(n)))
+}
+
+// tokenBucket refills at rate tokens per second up to burst. Takes may
+// overdraw it, later takes then wait for the debt to be paid back.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take removes n tokens and returns how long to wait until the bucket is no
+// longer overdrawn.
+func (b *tokenBucket) take(n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// allow removes n tokens if the bucket holds them. Requests larger than the
+// burst can never be covered; they are allowed on a full bucket and
+// overdraw it, so later requests wait for the debt to be paid back.
+func (b *tokenBucket) allow(n float64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	need := n
+	if need > b.burst {
+		need = b.burst
+	}
+	if b.tokens < need || b.tokens < 0 {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
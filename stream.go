@@ -0,0 +1,103 @@
+package blockservice
+
+import (
+	"context"
+	"sync"
+
+	"github.com/ipfs/go-cid"
+
+	"github.com/ipfs/go-blockservice/internal"
+)
+
+const defaultStreamConcurrency = 32
+
+// WithStreamConcurrency sets how many blocks GetBlocksStream fetches at
+// once, 32 by default.
+func WithStreamConcurrency(n int) Option {
+	return func(s *blockService) {
+		s.streamConcurrency = n
+	}
+}
+
+// StreamGetter is implemented by the BlockServices returned by New and by
+// sessions, to fetch blocks from a stream of CIDs. Callers type-assert to use
+// it.
+type StreamGetter interface {
+	// GetBlocksStream fetches the CIDs received on in according to the
+	// load level found in ctx and emits one Result per CID as soon as it is
+	// resolved. The channel is closed once in is closed and every CID has
+	// been answered, or early when ctx is done.
+	GetBlocksStream(ctx context.Context, in <-chan cid.Cid) <-chan Result
+}
+
+var (
+	_ StreamGetter = (*blockService)(nil)
+	_ StreamGetter = (*Session)(nil)
+)
+
+// GetBlocksStream fetches the CIDs received on in through a session of the
+// exchange. See StreamGetter.
+func (s *blockService) GetBlocksStream(ctx context.Context, in <-chan cid.Cid) <-chan Result {
+	ctx, span := internal.StartSpan(ctx, "blockService.GetBlocksStream")
+	defer span.End()
+
+	return NewSession(ctx, s).GetBlocksStream(ctx, in)
+}
+
+// GetBlocksStream gets the CIDs received on in in the context of a request
+// session. See StreamGetter.
+func (s *Session) GetBlocksStream(ctx context.Context, in <-chan cid.Cid) <-chan Result {
+	ctx, span := internal.StartSpan(ctx, "Session.GetBlocksStream")
+	defer span.End()
+
+	ctx, done := s.base.life.begin(ctx)
+	if done == nil {
+		return closedResults()
+	}
+	l := s.loader()
+	l.release = done
+	return getBlocksStream(ctx, in, l)
+}
+
+// getBlocksStream runs a fixed number of workers taking CIDs from in, so
+// local, titan and exchange lookups share the same concurrency.
+func getBlocksStream(ctx context.Context, in <-chan cid.Cid, l loader) <-chan Result {
+	workers := l.streamConcurrency
+	if workers <= 0 {
+		workers = defaultStreamConcurrency
+	}
+
+	out := make(chan Result)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				var c cid.Cid
+				select {
+				case k, ok := <-in:
+					if !ok {
+						return
+					}
+					c = k
+				case <-ctx.Done():
+					return
+				}
+
+				blk, err := getBlock(ctx, c, l) // hash security
+				select {
+				case out <- Result{Cid: c, Block: blk, Err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+		l.finish()
+	}()
+	return out
+}
@@ -2,12 +2,17 @@ package titan
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice/internal"
 	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/linguohua/titan/api"
 	"github.com/linguohua/titan/api/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"time"
 )
 
@@ -36,41 +41,72 @@ func NewClientTitan(ctx context.Context) (*ClientOfTitan, error) {
 	return ct, nil
 }
 
-// get edge url and token from titan schedule service
+// get edge url and token from titan schedule service, giving up when c.ctx
+// is done
 func (c *ClientOfTitan) getDownloadInfoFromScheduleService(cid cid.Cid) (*api.DownloadInfo, error) {
+	sctx, span := internal.StartSpan(c.ctx, "titan.getDownloadInfo", trace.WithAttributes(
+		attribute.Stringer("CID", cid),
+		attribute.Int("Schedulers", len(c.SchedulerURLs)),
+	))
+	defer span.End()
+
 	ch := make(chan *api.DownloadInfo)
 	// defer close(ch)
-	ctx, cancel := context.WithCancel(c.ctx)
+	ctx, cancel := context.WithCancel(sctx)
 	defer cancel()
 	for _, v := range c.SchedulerURLs {
 		value := v
 		go func(cx context.Context, url string) {
-			apiScheduler, closer, err := client.NewScheduler(c.ctx, url, nil)
+			cx, span := internal.StartSpan(cx, "titan.queryScheduler", trace.WithAttributes(
+				attribute.String("SchedulerURL", url),
+			))
+			defer span.End()
+
+			apiScheduler, closer, err := client.NewScheduler(cx, url, nil)
 			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
 				return
 			}
 			defer closer()
-			downloadInfo, err := apiScheduler.GetDownloadInfoWithBlock(c.ctx, cid.String(), "120.24.37.24")
+			downloadInfo, err := apiScheduler.GetDownloadInfoWithBlock(cx, cid.String(), "120.24.37.24")
 			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
 				return
 			}
+			span.SetAttributes(attribute.String("EdgeURL", downloadInfo.URL))
 			select {
+			case ch <- &downloadInfo:
 			case <-cx.Done():
-				return
-			default:
-				ch <- &downloadInfo
-				return
 			}
 		}(ctx, value)
 	}
+	timer := time.NewTimer(schedulerTimeout)
+	defer timer.Stop()
 	select {
 	case df := <-ch:
+		span.SetAttributes(attribute.String("EdgeURL", df.URL))
 		return df, nil
-	case <-time.Tick(5 * time.Second):
-		return nil, fmt.Errorf("%s", "get download info from titan schedule service time out")
+	case <-timer.C:
+		err := ErrSchedulerTimeout
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	case <-ctx.Done():
+		err := ctx.Err()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
 	}
 }
 
+// GetDownloadInfo returns the edge url and token the titan schedulers
+// answer for cid.
+func (c *ClientOfTitan) GetDownloadInfo(cid cid.Cid) (*api.DownloadInfo, error) {
+	return c.getDownloadInfoFromScheduleService(cid)
+}
+
 func (c *ClientOfTitan) GetDataFromEdgeNode(cid cid.Cid) ([]byte, error) {
 
 	df, err := c.getDownloadInfoFromScheduleService(cid)
@@ -79,8 +115,107 @@ func (c *ClientOfTitan) GetDataFromEdgeNode(cid cid.Cid) ([]byte, error) {
 	}
 
 	if df.URL == "" || df.Token == "" {
-		return nil, errors.New("404 Not Found")
+		return nil, ipld.ErrNotFound{Cid: cid}
 	}
 	logger.Info("edge ip : ", df.URL)
-	return getBlockByHttp(df.URL, df.Token, cid)
+	return c.downloadBlock(df, cid)
+}
+
+// downloadBlock gets cid from the edge node described by df, checks it
+// hashes to cid and records a receipt of the download once verified.
+func (c *ClientOfTitan) downloadBlock(df *api.DownloadInfo, cid cid.Cid) ([]byte, error) {
+	start := time.Now()
+	data, err := getBlockByHttp(c.ctx, df.URL, df.Token, cid)
+	if err != nil {
+		return nil, err
+	}
+
+	if !verifyBlock(cid, data) {
+		return nil, blocks.ErrWrongHash
+	}
+	recordReceipt(c.ctx, Receipt{
+		Cid:      cid.String(),
+		Edge:     df.URL,
+		Size:     int64(len(data)),
+		Start:    start,
+		Duration: time.Since(start),
+	})
+	return data, nil
+}
+
+// GetCarFromEdgeNode asks the edge node serving root for the DAG below it as
+// a CAR stream, limited to depth levels of links when depth is positive,
+// and calls put for every verified block. It returns ErrCarNotSupported if
+// the edge node only serves single blocks.
+func (c *ClientOfTitan) GetCarFromEdgeNode(root cid.Cid, depth int, put func(blocks.Block) error) error {
+	df, err := c.getDownloadInfoFromScheduleService(root)
+	if err != nil {
+		return err
+	}
+
+	if df.URL == "" || df.Token == "" {
+		return ipld.ErrNotFound{Cid: root}
+	}
+	logger.Info("edge ip : ", df.URL)
+	start := time.Now()
+	var size int64
+	err = getCarByHttp(c.ctx, df.URL, df.Token, root, depth, func(b blocks.Block) error {
+		size += int64(len(b.RawData()))
+		return put(b)
+	})
+	if err != nil {
+		return err
+	}
+	// every block of the stream was checked against its CID
+	recordReceipt(c.ctx, Receipt{
+		Cid:      root.String(),
+		Edge:     df.URL,
+		Size:     size,
+		Start:    start,
+		Duration: time.Since(start),
+	})
+	return nil
+}
+
+// DeleteBlocks tells every titan scheduler that the node identified by
+// deviceID no longer caches cids, through the node-side DeleteBlockRecords
+// call; the scheduler only drops its records and deletes nothing on the
+// device. It fails only if no scheduler could be told.
+func (c *ClientOfTitan) DeleteBlocks(deviceID string, cids []cid.Cid) error {
+	ctx, span := internal.StartSpan(c.ctx, "titan.DeleteBlocks", trace.WithAttributes(
+		attribute.Int("Count", len(cids)),
+		attribute.Int("Schedulers", len(c.SchedulerURLs)),
+	))
+	defer span.End()
+
+	keys := make([]string, 0, len(cids))
+	for _, k := range cids {
+		keys = append(keys, k.String())
+	}
+
+	var lastErr error
+	told := 0
+	for _, url := range c.SchedulerURLs {
+		apiScheduler, closer, err := client.NewScheduler(ctx, url, nil)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		failed, err := apiScheduler.DeleteBlockRecords(ctx, deviceID, keys)
+		closer()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for k, msg := range failed {
+			logger.Debugf("scheduler %s could not delete %s: %s", url, k, msg)
+		}
+		told++
+	}
+	if told == 0 && lastErr != nil {
+		span.RecordError(lastErr)
+		span.SetStatus(codes.Error, lastErr.Error())
+		return lastErr
+	}
+	return nil
 }
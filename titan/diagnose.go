@@ -0,0 +1,201 @@
+package titan
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/linguohua/titan/api/client"
+)
+
+// schedulerTimeout bounds each scheduler query of a diagnosis, like the
+// lookup done when fetching blocks.
+const schedulerTimeout = 5 * time.Second
+
+// Diagnosis reports every step of retrieving a block from titan.
+type Diagnosis struct {
+	Cid        string            `json:"cid"`
+	Schedulers []SchedulerReport `json:"schedulers"`
+	// Edge is nil when no scheduler returned an edge node.
+	Edge *EdgeReport `json:"edge,omitempty"`
+}
+
+// SchedulerReport is the outcome of asking one scheduler for download info.
+type SchedulerReport struct {
+	URL       string        `json:"url"`
+	Reachable bool          `json:"reachable"`
+	Latency   time.Duration `json:"latency"`
+	// EdgeURL and HasToken are the download info returned, the token
+	// itself is left out of the report.
+	EdgeURL  string `json:"edgeUrl,omitempty"`
+	HasToken bool   `json:"hasToken"`
+	Error    string `json:"error,omitempty"`
+}
+
+// EdgeReport is the outcome of downloading the block from the edge node
+// returned by the first scheduler that answered with one.
+type EdgeReport struct {
+	URL     string        `json:"url"`
+	Status  int           `json:"status,omitempty"`
+	Header  http.Header   `json:"header,omitempty"`
+	Latency time.Duration `json:"latency"`
+	Size    int           `json:"size"`
+	// Verified reports whether the downloaded bytes hash to the CID.
+	Verified bool   `json:"verified"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Diagnose asks every scheduler for the edge node serving k, then downloads
+// k from the first edge returned and checks the data. Failures are recorded
+// in the report rather than returned.
+func (c *ClientOfTitan) Diagnose(ctx context.Context, k cid.Cid) *Diagnosis {
+	d := &Diagnosis{
+		Cid:        k.String(),
+		Schedulers: make([]SchedulerReport, len(c.SchedulerURLs)),
+	}
+
+	var wg sync.WaitGroup
+	var tokens sync.Map
+	for i, url := range c.SchedulerURLs {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			report, token := querySchedulerForDiagnosis(ctx, url, k)
+			d.Schedulers[i] = report
+			tokens.Store(i, token)
+		}(i, url)
+	}
+	wg.Wait()
+
+	for i, s := range d.Schedulers {
+		if s.EdgeURL == "" || !s.HasToken {
+			continue
+		}
+		token, _ := tokens.Load(i)
+		d.Edge = probeEdge(ctx, s.EdgeURL, token.(string), k)
+		break
+	}
+	return d
+}
+
+func querySchedulerForDiagnosis(ctx context.Context, url string, k cid.Cid) (SchedulerReport, string) {
+	report := SchedulerReport{URL: url}
+	ctx, cancel := context.WithTimeout(ctx, schedulerTimeout)
+	defer cancel()
+
+	start := time.Now()
+	apiScheduler, closer, err := client.NewScheduler(ctx, url, nil)
+	if err != nil {
+		report.Latency = time.Since(start)
+		report.Error = err.Error()
+		return report, ""
+	}
+	defer closer()
+
+	df, err := apiScheduler.GetDownloadInfoWithBlock(ctx, k.String(), "120.24.37.24")
+	report.Latency = time.Since(start)
+	if err != nil {
+		report.Error = err.Error()
+		// an answer, even an error, means the scheduler is up
+		report.Reachable = ctx.Err() == nil && !isConnectionError(err)
+		return report, ""
+	}
+	report.Reachable = true
+	report.EdgeURL = df.URL
+	report.HasToken = df.Token != ""
+	return report, df.Token
+}
+
+func probeEdge(ctx context.Context, host, token string, k cid.Cid) *EdgeReport {
+	report := &EdgeReport{URL: host}
+
+	request, err := newEdgeRequest(ctx, fmt.Sprintf("%s%s%s", host, "?cid=", k.String()), token)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	start := time.Now()
+	resp, err := (&http.Client{Timeout: 300 * time.Second, Transport: httpTransport}).Do(request)
+	if err != nil {
+		report.Latency = time.Since(start)
+		report.Error = err.Error()
+		return report
+	}
+	defer resp.Body.Close()
+	report.Status = resp.StatusCode
+	report.Header = resp.Header
+
+	data, err := io.ReadAll(resp.Body)
+	report.Latency = time.Since(start)
+	report.Size = len(data)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	if resp.StatusCode != 200 {
+		report.Error = resp.Status
+		return report
+	}
+
+	sum, err := k.Prefix().Sum(data)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Verified = sum.Equals(k)
+	return report
+}
+
+func isConnectionError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "connection refused") ||
+		strings.Contains(msg, "no such host") ||
+		strings.Contains(msg, "websocket") ||
+		strings.Contains(msg, "dial")
+}
+
+// String formats the report for humans.
+func (d *Diagnosis) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "cid: %s\n", d.Cid)
+	for _, s := range d.Schedulers {
+		fmt.Fprintf(&b, "scheduler %s: reachable=%v latency=%s", s.URL, s.Reachable, s.Latency)
+		if s.EdgeURL != "" {
+			fmt.Fprintf(&b, " edge=%s token=%v", s.EdgeURL, s.HasToken)
+		}
+		if s.Error != "" {
+			fmt.Fprintf(&b, " error=%q", s.Error)
+		}
+		b.WriteString("\n")
+	}
+	if d.Edge == nil {
+		b.WriteString("edge: none returned\n")
+		return b.String()
+	}
+	e := d.Edge
+	fmt.Fprintf(&b, "edge %s: status=%d latency=%s size=%d verified=%v", e.URL, e.Status, e.Latency, e.Size, e.Verified)
+	if e.Error != "" {
+		fmt.Fprintf(&b, " error=%q", e.Error)
+	}
+	b.WriteString("\n")
+	for _, k := range sortedKeys(e.Header) {
+		fmt.Fprintf(&b, "  %s: %s\n", k, strings.Join(e.Header[k], ", "))
+	}
+	return b.String()
+}
+
+func sortedKeys(h http.Header) []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
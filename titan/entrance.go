@@ -2,6 +2,8 @@ package titan
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
@@ -9,7 +11,15 @@ import (
 
 const AppName = "edge"
 
-// GetBlockFromTitan request data from titan and Convert the get data into blocks
+// ErrCarNotSupported is returned when an edge node can't serve CAR streams.
+var ErrCarNotSupported = errors.New("edge node does not support car streams")
+
+// ErrSchedulerTimeout is returned when no titan scheduler answered in time.
+// It matches context.DeadlineExceeded.
+var ErrSchedulerTimeout = fmt.Errorf("get download info from titan schedule service time out: %w", context.DeadlineExceeded)
+
+// GetBlockFromTitan request data from titan and Convert the get data into blocks.
+// It returns ipld.ErrNotFound when no edge node serves k.
 func GetBlockFromTitan(ctx context.Context, k cid.Cid) (blocks.Block, error) {
 	if !k.Defined() {
 		return nil, ipld.ErrNotFound{Cid: k}
@@ -29,3 +39,65 @@ func GetBlockFromTitan(ctx context.Context, k cid.Cid) (blocks.Block, error) {
 
 	return blocks.NewBlockWithCid(data, k)
 }
+
+// HasBlockInTitan asks the titan schedulers whether an edge node can serve k,
+// without downloading the block.
+func HasBlockInTitan(ctx context.Context, k cid.Cid) (bool, error) {
+	if !k.Defined() {
+		return false, nil
+	}
+
+	client, err := NewClientTitan(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	df, err := client.getDownloadInfoFromScheduleService(k)
+	if err != nil {
+		return false, err
+	}
+	return df.URL != "" && df.Token != "", nil
+}
+
+// DeleteBlocksFromTitan tells titan that the node identified by deviceID no
+// longer caches ks.
+func DeleteBlocksFromTitan(ctx context.Context, deviceID string, ks []cid.Cid) error {
+	if len(ks) == 0 {
+		return nil
+	}
+
+	client, err := NewClientTitan(ctx)
+	if err != nil {
+		return err
+	}
+
+	return client.DeleteBlocks(deviceID, ks)
+}
+
+// GetCarFromTitan requests the DAG below root from titan as a single CAR
+// stream, limited to depth levels of links when depth is positive, and
+// calls put for every block after checking it hashes to its CID. Edge nodes
+// that only serve single blocks make it return ErrCarNotSupported.
+func GetCarFromTitan(ctx context.Context, root cid.Cid, depth int, put func(blocks.Block) error) error {
+	if !root.Defined() {
+		return ipld.ErrNotFound{Cid: root}
+	}
+
+	client, err := NewClientTitan(ctx)
+	if err != nil {
+		return err
+	}
+
+	return client.GetCarFromEdgeNode(root, depth, put)
+}
+
+// CloseIdleConnections closes the idle connections to edge nodes.
+func CloseIdleConnections() {
+	httpTransport.CloseIdleConnections()
+}
+
+// Configured reports whether ctx carries titan scheduler addresses.
+func Configured(ctx context.Context) bool {
+	addrs, ok := ctx.Value("TitanIps").([]string)
+	return ok && len(addrs) != 0
+}
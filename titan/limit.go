@@ -0,0 +1,50 @@
+package titan
+
+import (
+	"context"
+	"io"
+)
+
+// ReadLimiter throttles the data read from edge nodes. WaitN blocks until n
+// bytes may be consumed or returns an error when they may not.
+type ReadLimiter interface {
+	WaitN(ctx context.Context, n int) error
+}
+
+type readLimiterKey struct{}
+
+// WithReadLimiter returns a context whose edge downloads are throttled by l.
+func WithReadLimiter(ctx context.Context, l ReadLimiter) context.Context {
+	return context.WithValue(ctx, readLimiterKey{}, l)
+}
+
+// maxLimitedRead caps single reads of a limited body so waits stay short.
+const maxLimitedRead = 32 << 10
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   ReadLimiter
+}
+
+// limitReader throttles r by the ReadLimiter found in ctx, if any.
+func limitReader(ctx context.Context, r io.Reader) io.Reader {
+	l, ok := ctx.Value(readLimiterKey{}).(ReadLimiter)
+	if !ok || l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxLimitedRead {
+		p = p[:maxLimitedRead]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.l.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,234 @@
+package titan
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Receipt acknowledges data received from an edge node and verified against
+// its CID, so that titan can reward the edge for serving it.
+type Receipt struct {
+	Cid  string `json:"cid"`
+	Edge string `json:"edge"`
+	// Size is the number of block bytes received.
+	Size      int64         `json:"size"`
+	Start     time.Time     `json:"start"`
+	Duration  time.Duration `json:"duration"`
+	Signature []byte        `json:"signature,omitempty"`
+}
+
+// SigningBytes returns the bytes covered by the signature of r.
+func (r Receipt) SigningBytes() ([]byte, error) {
+	r.Signature = nil
+	return json.Marshal(r)
+}
+
+// Signer signs receipts. The private keys of libp2p nodes implement it, so
+// receipts can be signed with the node key.
+type Signer interface {
+	Sign(data []byte) ([]byte, error)
+}
+
+// ReceiptSubmitter hands batches of signed receipts over to titan. The
+// scheduler RPC has no call accepting receipts, so callers must supply their
+// own submitter, for instance one posting to their titan reward service.
+type ReceiptSubmitter interface {
+	SubmitReceipts(ctx context.Context, rs []Receipt) error
+}
+
+const (
+	defaultReceiptBatch    = 64
+	defaultReceiptInterval = 30 * time.Second
+	defaultReceiptPending  = 4096
+	// receiptSubmitTimeout bounds the submissions made in the background.
+	receiptSubmitTimeout = 30 * time.Second
+)
+
+// ReceiptOptions tunes the batching of receipts. Zero values select the
+// defaults.
+type ReceiptOptions struct {
+	// BatchSize is the number of receipts sent per submission, 64 by
+	// default. Reaching it submits the pending receipts right away, so 1
+	// submits every receipt as soon as it is signed.
+	BatchSize int
+	// FlushInterval is how often pending receipts are submitted, 30s by
+	// default.
+	FlushInterval time.Duration
+	// MaxPending bounds the receipts kept while submissions fail, 4096 by
+	// default. The oldest receipts are dropped first.
+	MaxPending int
+}
+
+// Receipts signs the receipts of the downloads made with a context from
+// WithReceipts and submits them in batches. Receipts failing to submit are
+// retried with the next batch.
+type Receipts struct {
+	signer    Signer
+	submitter ReceiptSubmitter
+	opts      ReceiptOptions
+
+	lk      sync.Mutex
+	pending []Receipt
+	dropped uint64 // receipts ever dropped by trim
+	// submitLk serializes submissions so batches are sent in order.
+	submitLk sync.Mutex
+
+	kick      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewReceipts returns a receipt queue signing with signer and submitting
+// through submitter. Close must be called to submit the last receipts and
+// stop its background submissions.
+func NewReceipts(signer Signer, submitter ReceiptSubmitter, opts ReceiptOptions) *Receipts {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultReceiptBatch
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultReceiptInterval
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = defaultReceiptPending
+	}
+	r := &Receipts{
+		signer:    signer,
+		submitter: submitter,
+		opts:      opts,
+		kick:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go r.loop()
+	return r
+}
+
+type receiptsKey struct{}
+
+// WithReceipts returns a context whose verified edge downloads produce
+// receipts queued on r.
+func WithReceipts(ctx context.Context, r *Receipts) context.Context {
+	return context.WithValue(ctx, receiptsKey{}, r)
+}
+
+// recordReceipt queues rc on the Receipts found in ctx, if any.
+func recordReceipt(ctx context.Context, rc Receipt) {
+	r, ok := ctx.Value(receiptsKey{}).(*Receipts)
+	if !ok || r == nil {
+		return
+	}
+	if err := r.add(rc); err != nil {
+		logger.Errorf("could not sign retrieval receipt for %s: %s", rc.Cid, err)
+	}
+}
+
+// add signs rc and queues it for submission.
+func (r *Receipts) add(rc Receipt) error {
+	data, err := rc.SigningBytes()
+	if err != nil {
+		return err
+	}
+	rc.Signature, err = r.signer.Sign(data)
+	if err != nil {
+		return err
+	}
+
+	r.lk.Lock()
+	r.pending = append(r.pending, rc)
+	r.trim()
+	full := len(r.pending) >= r.opts.BatchSize
+	r.lk.Unlock()
+
+	if full {
+		select {
+		case r.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// trim drops the oldest receipts over MaxPending, the lock must be held.
+func (r *Receipts) trim() {
+	if over := len(r.pending) - r.opts.MaxPending; over > 0 {
+		logger.Warnf("dropping %d retrieval receipts not submitted in time", over)
+		r.pending = append(r.pending[:0:0], r.pending[over:]...)
+		r.dropped += uint64(over)
+	}
+}
+
+func (r *Receipts) loop() {
+	defer close(r.stopped)
+	ticker := time.NewTicker(r.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.kick:
+		case <-ticker.C:
+		case <-r.done:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), receiptSubmitTimeout)
+		if err := r.Flush(ctx); err != nil {
+			logger.Warnf("could not submit retrieval receipts: %s", err)
+		}
+		cancel()
+	}
+}
+
+// Flush submits the pending receipts in batches of BatchSize. Receipts of a
+// failed batch stay pending.
+func (r *Receipts) Flush(ctx context.Context) error {
+	r.submitLk.Lock()
+	defer r.submitLk.Unlock()
+	for {
+		r.lk.Lock()
+		n := len(r.pending)
+		if n > r.opts.BatchSize {
+			n = r.opts.BatchSize
+		}
+		batch := append([]Receipt(nil), r.pending[:n]...)
+		dropped := r.dropped
+		r.lk.Unlock()
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := r.submitter.SubmitReceipts(ctx, batch); err != nil {
+			return err
+		}
+
+		// trim drops from the front, the batch may be partly gone already
+		r.lk.Lock()
+		sent := len(batch) - int(r.dropped-dropped)
+		if sent > 0 {
+			r.pending = r.pending[sent:]
+		}
+		r.lk.Unlock()
+	}
+}
+
+// Close stops the background submissions and submits the pending receipts.
+// Calling Close again returns the first result.
+func (r *Receipts) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.done)
+		<-r.stopped
+		ctx, cancel := context.WithTimeout(context.Background(), receiptSubmitTimeout)
+		defer cancel()
+		r.closeErr = r.Flush(ctx)
+	})
+	return r.closeErr
+}
+
+// verifyBlock reports whether data hashes to c.
+func verifyBlock(c cid.Cid, data []byte) bool {
+	chk, err := c.Prefix().Sum(data)
+	return err == nil && chk.Equals(c)
+}
@@ -1,23 +1,38 @@
 package titan
 
 import (
+	"context"
 	"fmt"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-blockservice/internal"
+	"github.com/ipfs/go-blockservice/internal/car"
 	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
 	ma "github.com/multiformats/go-multiaddr"
 	manet "github.com/multiformats/go-multiaddr/net"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
 const RPCProtocol = "/rpc/v0"
 
-// getBlockByHttp connect Titan net by http get method
-func getBlockByHttp(host, token string, cid cid.Cid) ([]byte, error) {
-	// set http request timed out five second
-	client := &http.Client{Timeout: 300 * time.Second}
-	url := fmt.Sprintf("%s%s%s", host, "?cid=", cid.String())
-	request, err := http.NewRequest("GET", url, nil)
+// httpTransport is shared by the requests to edge nodes so that their
+// connections can be reused and closed together.
+var httpTransport = http.DefaultTransport.(*http.Transport).Clone()
+
+// CarContentType is the media type of CAR streams served by edge nodes.
+const CarContentType = "application/vnd.ipld.car"
+
+// newEdgeRequest builds a GET request to an edge node carrying the download
+// token and the trace context
+func newEdgeRequest(ctx context.Context, url, token string) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -25,28 +40,129 @@ func getBlockByHttp(host, token string, cid cid.Cid) ([]byte, error) {
 	// set request header, eg: token
 	request.Header.Set("Token", token)
 	request.Header.Set("App-Name", AppName)
+	// propagate the trace context to the edge node
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(request.Header))
+	return request, nil
+}
+
+// getBlockByHttp connect Titan net by http get method
+func getBlockByHttp(ctx context.Context, host, token string, cid cid.Cid) ([]byte, error) {
+	ctx, span := internal.StartSpan(ctx, "titan.getBlockByHttp", trace.WithAttributes(
+		attribute.Stringer("CID", cid),
+		attribute.String("EdgeURL", host),
+	))
+	defer span.End()
+
+	// set http request timed out five second
+	client := &http.Client{Timeout: 300 * time.Second, Transport: httpTransport}
+	url := fmt.Sprintf("%s%s%s", host, "?cid=", cid.String())
+	request, err := newEdgeRequest(ctx, url, token)
+	if err != nil {
+		return nil, err
+	}
 
 	// request do
 	resp, err := client.Do(request)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
+	span.SetAttributes(attribute.Int("HTTPStatus", resp.StatusCode))
 
 	// Judge the return status
 	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		span.SetStatus(codes.Error, resp.Status)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, ipld.ErrNotFound{Cid: cid}
+		}
 		return nil, fmt.Errorf("%s", resp.Status)
 	}
 
 	defer resp.Body.Close()
 
-	result, err := io.ReadAll(resp.Body)
+	result, err := io.ReadAll(limitReader(ctx, resp.Body))
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
+	span.SetAttributes(attribute.Int("Size", len(result)))
 
 	return result, nil
 }
 
+// getCarByHttp requests the DAG below root as a CAR stream from an edge node
+// and calls put for every verified block
+func getCarByHttp(ctx context.Context, host, token string, root cid.Cid, depth int, put func(blocks.Block) error) error {
+	ctx, span := internal.StartSpan(ctx, "titan.getCarByHttp", trace.WithAttributes(
+		attribute.Stringer("CID", root),
+		attribute.String("EdgeURL", host),
+		attribute.Int("Depth", depth),
+	))
+	defer span.End()
+
+	client := &http.Client{Timeout: 300 * time.Second, Transport: httpTransport}
+	url := fmt.Sprintf("%s%s%s%s", host, "?cid=", root.String(), "&format=car")
+	if depth > 0 {
+		url = fmt.Sprintf("%s&depth=%d", url, depth)
+	}
+	request, err := newEdgeRequest(ctx, url, token)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", CarContentType)
+
+	resp, err := client.Do(request)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("HTTPStatus", resp.StatusCode))
+
+	switch {
+	case resp.StatusCode == http.StatusNotAcceptable || resp.StatusCode == http.StatusNotImplemented:
+		return ErrCarNotSupported
+	case resp.StatusCode == http.StatusNotFound:
+		span.SetStatus(codes.Error, resp.Status)
+		return ipld.ErrNotFound{Cid: root}
+	case resp.StatusCode != 200:
+		span.SetStatus(codes.Error, resp.Status)
+		return fmt.Errorf("%s", resp.Status)
+	case !strings.HasPrefix(resp.Header.Get("Content-Type"), CarContentType):
+		// older edge nodes ignore the format and answer with the root block
+		return ErrCarNotSupported
+	}
+
+	cr, err := car.NewReader(limitReader(ctx, resp.Body))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	count := 0
+	for {
+		b, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+		if err := put(b); err != nil {
+			return err
+		}
+		count++
+	}
+	span.SetAttributes(attribute.Int("Blocks", count))
+	return nil
+}
+
 func transformationMultiAddrStringsToUrl(multiAddrStrings []string) ([]string, error) {
 	if len(multiAddrStrings) == 0 {
 		return nil, fmt.Errorf("multi address is null")
@@ -0,0 +1,332 @@
+package titan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filecoin-project/go-jsonrpc"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/linguohua/titan/api"
+
+	"github.com/ipfs/go-blockservice/internal/car"
+)
+
+func TestGetCarByHttp(t *testing.T) {
+	blks := []blocks.Block{
+		blocks.NewBlock([]byte("root")),
+		blocks.NewBlock([]byte("child")),
+	}
+	var payload bytes.Buffer
+	cw, err := car.NewWriter(&payload, []cid.Cid{blks[0].Cid()}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blks {
+		if err := cw.Put(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	edge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Token") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("format") != "car" || r.URL.Query().Get("depth") != "2" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", CarContentType)
+		w.Write(payload.Bytes())
+	}))
+	defer edge.Close()
+
+	var got []blocks.Block
+	err = getCarByHttp(context.Background(), edge.URL, "token", blks[0].Cid(), 2, func(b blocks.Block) error {
+		got = append(got, b)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(blks) {
+		t.Fatalf("expected %d blocks, got %d", len(blks), len(got))
+	}
+	for i, b := range blks {
+		if got[i].Cid() != b.Cid() {
+			t.Fatalf("expected block %s, got %s", b.Cid(), got[i].Cid())
+		}
+	}
+}
+
+func TestGetCarByHttpNotSupported(t *testing.T) {
+	root := blocks.NewBlock([]byte("root"))
+	edge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(root.RawData())
+	}))
+	defer edge.Close()
+
+	err := getCarByHttp(context.Background(), edge.URL, "token", root.Cid(), 0, func(blocks.Block) error {
+		t.Fatal("no block should be delivered")
+		return nil
+	})
+	if !errors.Is(err, ErrCarNotSupported) {
+		t.Fatalf("expected ErrCarNotSupported, got %v", err)
+	}
+}
+
+func TestProbeEdge(t *testing.T) {
+	blk := blocks.NewBlock([]byte("probed"))
+	edge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Edge", "test")
+		switch r.URL.Query().Get("cid") {
+		case blk.Cid().String():
+			w.Write(blk.RawData())
+		default:
+			w.Write([]byte("something else"))
+		}
+	}))
+	defer edge.Close()
+
+	report := probeEdge(context.Background(), edge.URL, "token", blk.Cid())
+	if report.Error != "" {
+		t.Fatal(report.Error)
+	}
+	if report.Status != http.StatusOK || report.Header.Get("X-Edge") != "test" {
+		t.Fatalf("unexpected status %d and header %v", report.Status, report.Header)
+	}
+	if !report.Verified || report.Size != len(blk.RawData()) {
+		t.Fatalf("expected verified block of %d bytes, got %+v", len(blk.RawData()), report)
+	}
+
+	other := blocks.NewBlock([]byte("not served"))
+	report = probeEdge(context.Background(), edge.URL, "token", other.Cid())
+	if report.Verified {
+		t.Fatal("expected data of another block not to verify")
+	}
+}
+
+func TestDiagnoseUnreachableScheduler(t *testing.T) {
+	c := &ClientOfTitan{SchedulerURLs: []string{"http://127.0.0.1:1/rpc/v0"}}
+	d := c.Diagnose(context.Background(), blocks.NewBlock([]byte("x")).Cid())
+	if len(d.Schedulers) != 1 || d.Schedulers[0].Reachable || d.Schedulers[0].Error == "" {
+		t.Fatalf("expected an unreachable scheduler, got %+v", d.Schedulers)
+	}
+	if d.Edge != nil {
+		t.Fatal("expected no edge probe without download info")
+	}
+}
+
+// recordingScheduler records the deletion calls it receives.
+type recordingScheduler struct {
+	lk    sync.Mutex
+	calls []string
+}
+
+func (s *recordingScheduler) record(method, deviceID string, cids []string) map[string]string {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.calls = append(s.calls, fmt.Sprintf("%s %s %d", method, deviceID, len(cids)))
+	return map[string]string{}
+}
+
+func (s *recordingScheduler) DeleteBlocks(_ context.Context, deviceID string, cids []string) (map[string]string, error) {
+	return s.record("DeleteBlocks", deviceID, cids), nil
+}
+
+func (s *recordingScheduler) DeleteBlockRecords(_ context.Context, deviceID string, cids []string) (map[string]string, error) {
+	return s.record("DeleteBlockRecords", deviceID, cids), nil
+}
+
+// newSchedulerServer serves handler as a titan scheduler RPC and returns its
+// multiaddress.
+func newSchedulerServer(t *testing.T, handler interface{}) string {
+	rpc := jsonrpc.NewServer()
+	rpc.Register("titan", handler)
+	mux := http.NewServeMux()
+	mux.Handle(RPCProtocol, rpc)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("/ip4/%s/tcp/%s", host, port)
+}
+
+func TestDeleteBlocksFromTitan(t *testing.T) {
+	sched := &recordingScheduler{}
+	ctx := context.WithValue(context.Background(), "TitanIps", []string{newSchedulerServer(t, sched)})
+	ks := []cid.Cid{blocks.NewBlock([]byte("a")).Cid(), blocks.NewBlock([]byte("b")).Cid()}
+
+	if err := DeleteBlocksFromTitan(ctx, "device", ks); err != nil {
+		t.Fatal(err)
+	}
+	if len(sched.calls) != 1 || sched.calls[0] != "DeleteBlockRecords device 2" {
+		t.Fatalf("expected only the block records to be deleted, got %v", sched.calls)
+	}
+}
+
+// hangingScheduler answers download info requests only once release is
+// closed.
+type hangingScheduler struct {
+	release chan struct{}
+}
+
+func (s *hangingScheduler) GetDownloadInfoWithBlock(ctx context.Context, _, _ string) (api.DownloadInfo, error) {
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+	}
+	return api.DownloadInfo{}, nil
+}
+
+func TestGetBlockFromTitanCancel(t *testing.T) {
+	sched := &hangingScheduler{release: make(chan struct{})}
+	addr := newSchedulerServer(t, sched)
+	t.Cleanup(func() { close(sched.release) })
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "TitanIps", []string{addr}))
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := GetBlockFromTitan(ctx, blocks.NewBlock([]byte("x")).Cid())
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if d := time.Since(start); d >= schedulerTimeout {
+		t.Fatalf("cancelling took %s", d)
+	}
+}
+
+type countingLimiter struct {
+	n int
+}
+
+func (l *countingLimiter) WaitN(_ context.Context, n int) error {
+	l.n += n
+	return nil
+}
+
+func TestGetBlockByHttpReadLimiter(t *testing.T) {
+	blk := blocks.NewBlock(bytes.Repeat([]byte("a"), 100<<10))
+	edge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(blk.RawData())
+	}))
+	defer edge.Close()
+
+	lim := &countingLimiter{}
+	data, err := getBlockByHttp(WithReadLimiter(context.Background(), lim), edge.URL, "token", blk.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lim.n != len(data) || len(data) != len(blk.RawData()) {
+		t.Fatalf("expected %d bytes to go through the limiter, got %d", len(blk.RawData()), lim.n)
+	}
+}
+
+type prefixSigner struct{}
+
+func (prefixSigner) Sign(data []byte) ([]byte, error) {
+	return append([]byte("signed:"), data...), nil
+}
+
+type recordingSubmitter struct {
+	lk      sync.Mutex
+	batches [][]Receipt
+}
+
+func (s *recordingSubmitter) SubmitReceipts(_ context.Context, rs []Receipt) error {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	s.batches = append(s.batches, rs)
+	return nil
+}
+
+func TestDownloadBlockReceipt(t *testing.T) {
+	blk := blocks.NewBlock([]byte("received"))
+	edge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("cid") == blk.Cid().String() {
+			w.Write(blk.RawData())
+			return
+		}
+		w.Write([]byte("something else"))
+	}))
+	defer edge.Close()
+
+	sub := &recordingSubmitter{}
+	receipts := NewReceipts(prefixSigner{}, sub, ReceiptOptions{FlushInterval: time.Hour})
+	c := &ClientOfTitan{ctx: WithReceipts(context.Background(), receipts)}
+	df := &api.DownloadInfo{URL: edge.URL, Token: "token"}
+
+	if _, err := c.downloadBlock(df, blk.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	other := blocks.NewBlock([]byte("not served"))
+	if _, err := c.downloadBlock(df, other.Cid()); err != blocks.ErrWrongHash {
+		t.Fatalf("expected ErrWrongHash, got %v", err)
+	}
+	if err := receipts.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the wrong-hash download must not be acknowledged
+	if len(sub.batches) != 1 || len(sub.batches[0]) != 1 {
+		t.Fatalf("expected one batch of one receipt, got %v", sub.batches)
+	}
+	good := sub.batches[0][0]
+	if good.Cid != blk.Cid().String() || good.Edge != edge.URL || good.Size != int64(len(blk.RawData())) {
+		t.Fatalf("unexpected receipt %+v", good)
+	}
+	data, err := good.SigningBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(good.Signature, append([]byte("signed:"), data...)) {
+		t.Fatal("receipt not signed over its content")
+	}
+}
+
+type chanSubmitter struct {
+	received chan []Receipt
+}
+
+func (s *chanSubmitter) SubmitReceipts(_ context.Context, rs []Receipt) error {
+	s.received <- rs
+	return nil
+}
+
+func TestReceiptBatches(t *testing.T) {
+	sub := &chanSubmitter{received: make(chan []Receipt, 2)}
+	receipts := NewReceipts(prefixSigner{}, sub, ReceiptOptions{BatchSize: 2, FlushInterval: time.Hour})
+	for i := 0; i < 3; i++ {
+		c := blocks.NewBlock([]byte{byte(i)}).Cid()
+		if err := receipts.add(Receipt{Cid: c.String()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case rs := <-sub.received:
+		if len(rs) != 2 || len(rs[0].Signature) == 0 {
+			t.Fatalf("expected a full batch of signed receipts, got %+v", rs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("full batch not submitted")
+	}
+	if err := receipts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rs := <-sub.received; len(rs) != 1 {
+		t.Fatalf("expected the last receipt on close, got %+v", rs)
+	}
+}
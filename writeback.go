@@ -0,0 +1,122 @@
+package blockservice
+
+import (
+	"context"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+)
+
+// forwardFetched is the last stage of every load level fetching from the
+// exchange. Blocks received on in are sent to out as they arrive and handed
+// in batches to a writer, which stores them and tells the exchange about
+// them. A write or notify failure ends the stage. It returns once in is
+// closed or ctx is done and every batch has been written.
+func (l *loader) forwardFetched(ctx context.Context, f notifiableFetcher, in <-chan blocks.Block, out chan<- blocks.Block) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batches := make(chan []blocks.Block, writeBackQueue)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		l.writeBack(ctx, f, batches, cancel)
+	}()
+
+	size, latency := l.batching()
+	batch := make([]blocks.Block, 0, size)
+	defer func() {
+		// blocks already delivered are worth keeping even when the
+		// request is cancelled
+		if len(batch) != 0 {
+			batches <- batch
+		}
+		close(batches)
+		<-written
+	}()
+
+	var flush <-chan time.Time
+	var timer *time.Timer
+	for {
+		select {
+		case b, ok := <-in:
+			if !ok {
+				return
+			}
+			logger.Debugf("got block success from ipfs network By cid : %s", b.Cid())
+			select {
+			case out <- b:
+			case <-ctx.Done():
+				return
+			}
+			batch = append(batch, b)
+			if len(batch) == 1 {
+				timer = time.NewTimer(latency)
+				flush = timer.C
+			}
+			if len(batch) < size {
+				continue
+			}
+			timer.Stop()
+		case <-flush:
+		case <-ctx.Done():
+			return
+		}
+		flush = nil
+		batches <- batch
+		batch = make([]blocks.Block, 0, size)
+	}
+}
+
+// writeBack writes batches of blocks received from the exchange to the
+// blockstore and tells the exchange about them. With CacheStrict the first
+// failure stops the stage through cancel and later batches are dropped.
+func (l *loader) writeBack(ctx context.Context, f notifiableFetcher, batches <-chan []blocks.Block, cancel context.CancelFunc) {
+	failed := false
+	for batch := range batches {
+		if failed {
+			continue
+		}
+		if err := l.writeFetched(ctx, f, batch...); err != nil {
+			failed = true
+			cancel()
+		}
+	}
+}
+
+// writeFetched writes blocks received from the exchange to the blockstore
+// for caching and informs the exchange that they are available, unless they
+// went to the fetch cache. Failures are only returned with CacheStrict.
+func (l *loader) writeFetched(ctx context.Context, f notifiableFetcher, blks ...blocks.Block) error {
+	if err := l.putFetched(ctx, blks...); err != nil {
+		logger.Errorf("could not write blocks from the network to the blockstore: %s", err)
+		if l.policy == CacheStrict {
+			return err
+		}
+		// don't announce blocks we could not store
+		return nil
+	}
+	if l.fetched != nil {
+		// the exchange can't serve blocks of the fetch cache to peers
+		return nil
+	}
+	if err := f.NotifyNewBlocks(ctx, blks...); err != nil {
+		logger.Errorf("could not tell the exchange about new blocks: %s", err)
+		if l.policy == CacheStrict {
+			return err
+		}
+	}
+	return nil
+}
+
+// batching returns the write-back batch size and flush latency.
+func (l *loader) batching() (int, time.Duration) {
+	size, latency := l.batchSize, l.batchLatency
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	if latency <= 0 {
+		latency = defaultBatchLatency
+	}
+	return size, latency
+}